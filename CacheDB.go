@@ -1,20 +1,29 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"strings"
 	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-// This stores the detail of a single find event.
+// This stores the detail of a single log on a cache. Despite the name it isn't
+// only finds, FindType says what kind of log it was.
 type CacheFind struct {
 	gorm.Model
 	Name      string
-	FindTime  time.Time
-	FindType  string
+	FindTime  time.Time // When the log says the cache was visited, in UTC.
+	FindType  string    // The name of the log type, E.G. "Found it" or "Didn't find it"
+	LogTypeID int
+	LogID     int    `gorm:"index"` // The gc.com log's ID. This is 0 for finds recorded before we kept it.
+	LogGUID   string `gorm:"index"`
+	AccountID int    // The gc.com account ID of the person who wrote the log.
 	CacheCode string
 	LogString string
+	Posts     []PostedStatus // What we've published about this find.
 }
 
 type Cache struct {
@@ -23,6 +32,24 @@ type Cache struct {
 	LastFoundTime time.Time
 	Updated       bool `gorm:"-"` // This is not stored in the database, it is used to track if the cache was updated.
 	New           bool `gorm:"-"` // This is not stored in the database, it is used to track if the cache was updated.
+
+	// These are as of the last time we saw the cache in a search.
+	Name        string
+	AreaName    string
+	Status      CacheStatus
+	StatusKnown bool // This is false for caches recorded before we kept their status.
+	Missing     bool // The cache has stopped showing up in searches.
+}
+
+// This records a change to a cache's status, or it disappearing from or
+// reappearing in our searches.
+type CacheStatusChange struct {
+	gorm.Model
+	CacheCode string `gorm:"index"`
+	Kind      string // The kind of post the change makes, E.G. "CacheArchived". See logtypes.go.
+	From      CacheStatus
+	To        CacheStatus
+	ChangedAt time.Time
 }
 
 type State struct {
@@ -30,6 +57,65 @@ type State struct {
 	LastPostedFoundTime time.Time
 }
 
+// This records that we've searched an area before, so we know whether the caches
+// we find in it are new or were just never seen.
+type SearchArea struct {
+	gorm.Model
+	AreaName string `gorm:"uniqueIndex"`
+}
+
+// The states an OutboxPost can be in.
+const (
+	outboxPending = "pending"
+	outboxSent    = "sent"
+	outboxFailed  = "failed"
+	// The post was already on the publisher's timeline, so we didn't send it again.
+	outboxDuplicate = "duplicate"
+)
+
+// This is a post waiting to be delivered to a single publisher. Posts stay in
+// the table after delivery so we have a record of what happened to them.
+type OutboxPost struct {
+	gorm.Model
+	Publisher   string `gorm:"index"`
+	Payload     string // The postDetails, as JSON
+	Status      string `gorm:"index"`
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	SentAt      time.Time
+}
+
+// This records a status that has been posted by one of our publishers, either
+// because we sent it or because we found it when reading back the timeline.
+type PostedStatus struct {
+	gorm.Model
+	Publisher   string `gorm:"index"`
+	StatusID    string `gorm:"index"`
+	URL         string
+	CacheCode   string `gorm:"index"`
+	UserName    string
+	Kind        string // This is empty for statuses read back from the timeline.
+	Text        string
+	PostedAt    time.Time
+	CacheFindID *uint `gorm:"index"` // This is nil for posts that aren't about a find, or that we couldn't match to one.
+}
+
+// This is a log waiting to go into the next digest post.
+type DigestEntry struct {
+	gorm.Model
+	AreaName   string `gorm:"index"`
+	Kind       string
+	LogType    string
+	UserName   string
+	CacheName  string
+	CacheCode  string
+	DetailsURL string
+	LogText    string
+	LoggedAt   time.Time
+	Digested   bool `gorm:"index"`
+}
+
 // This stores the finder database.
 type FinderDB struct {
 	db *gorm.DB
@@ -47,10 +133,45 @@ func (f *FinderDB) Init(filename string) error {
 	f.db.AutoMigrate(&CacheFind{})
 	f.db.AutoMigrate(&Cache{})
 	f.db.AutoMigrate(&State{})
+	f.db.AutoMigrate(&OutboxPost{})
+	f.db.AutoMigrate(&PostedStatus{})
+	f.db.AutoMigrate(&DigestEntry{})
+	f.db.AutoMigrate(&SearchArea{})
+	f.db.AutoMigrate(&CacheStatusChange{})
+	if err = f.uniqueLogIDs(); err != nil {
+		return err
+	}
+
+	// SQLite only allows one writer at a time, and the outbox is written from
+	// its own goroutine. Funnel everything through one connection rather than
+	// dealing with "database is locked" errors.
+	sqlDB, err := f.db.DB()
+	if err != nil {
+		return err
+	}
+	sqlDB.SetMaxOpenConns(1)
 
 	return nil
 }
 
+// This makes sure we only ever store a log once. Rows recorded before we kept
+// the log's ID have a LogID of 0 and are left alone. Any duplicates that were
+// stored before the index existed are removed, keeping the oldest.
+func (f *FinderDB) uniqueLogIDs() error {
+	return f.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`DELETE FROM cache_finds WHERE log_id <> 0 AND id NOT IN
+			(SELECT MIN(id) FROM cache_finds WHERE log_id <> 0 GROUP BY log_id)`).Error; err != nil {
+			return err
+		}
+		return tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_cache_finds_log_id_unique ON cache_finds(log_id) WHERE log_id <> 0").Error
+	})
+}
+
+// This returns a copy of the DB whose queries are cancelled along with ctx.
+func (f *FinderDB) WithContext(ctx context.Context) *FinderDB {
+	return &FinderDB{db: f.db.WithContext(ctx)}
+}
+
 // Close the DB.
 func (f *FinderDB) Close() error {
 	sqlDB, err := f.db.DB()
@@ -85,10 +206,14 @@ func (f *FinderDB) SetLastPostedFoundTime(t time.Time) {
 	f.db.Save(&state)
 }
 
-// TODO If a new cache shows up in the database publish a message about it.
+// This returns the number of caches we know about.
+func (f *FinderDB) CacheCount() int {
+	var count int64
+	f.db.Model(&Cache{}).Count(&count)
+	return int(count)
+}
 
 // This adds a cache to the database. If the cache already exists, it is not added.
-
 func (f *FinderDB) UpdateCache(gc *Geocache) (new bool, updated bool) {
 	var count int64
 	f.db.Model(&Cache{}).Where("code = ?", gc.Code).Count(&count)
@@ -114,29 +239,340 @@ func (f *FinderDB) UpdateCache(gc *Geocache) (new bool, updated bool) {
 	return new, updated
 }
 
-// This adds a find to the database
-func (f *FinderDB) AddLog(cf *GeocacheLog, gc *Geocache) {
-	f.db.Create(&CacheFind{
+// This records the cache's status as of a search in the given area. If its status
+// has changed since we last saw it, or it's reappeared after going missing, the
+// change is recorded and returned. Otherwise this returns nil.
+func (f *FinderDB) UpdateCacheStatus(gc *Geocache, areaName string, now time.Time) *CacheStatusChange {
+	var cache Cache
+	if tx := f.db.Limit(1).Find(&cache, "code = ?", gc.Code); tx.RowsAffected == 0 {
+		return nil
+	}
+	var change *CacheStatusChange
+	switch {
+	case cache.StatusKnown && cache.Missing:
+		change = &CacheStatusChange{Kind: kindCacheReappeared}
+	case cache.StatusKnown && cache.Status != gc.CacheStatus:
+		change = &CacheStatusChange{Kind: statusChangeKind(cache.Status, gc.CacheStatus)}
+	}
+	if change != nil {
+		change.CacheCode = gc.Code
+		change.From = cache.Status
+		change.To = gc.CacheStatus
+		change.ChangedAt = now
+		f.db.Create(change)
+	}
+	f.db.Model(&cache).Updates(map[string]any{
+		"name":         gc.Name,
+		"area_name":    areaName,
+		"status":       gc.CacheStatus,
+		"status_known": true,
+		"missing":      false,
+	})
+	return change
+}
+
+// This returns the caches we know the status of that haven't gone missing, and
+// aren't in seen, which is keyed by cache code.
+func (f *FinderDB) UnseenCaches(seen map[string]bool) []Cache {
+	var caches, unseen []Cache
+	f.db.Where("status_known = ? AND missing = ?", true, false).Find(&caches)
+	for _, cache := range caches {
+		if !seen[cache.Code] {
+			unseen = append(unseen, cache)
+		}
+	}
+	return unseen
+}
+
+// This records that the cache has stopped showing up in searches.
+func (f *FinderDB) MarkCacheMissing(cache *Cache, now time.Time) *CacheStatusChange {
+	change := &CacheStatusChange{
+		CacheCode: cache.Code,
+		Kind:      kindCacheMissing,
+		From:      cache.Status,
+		To:        cache.Status,
+		ChangedAt: now,
+	}
+	f.db.Create(change)
+	f.db.Model(cache).Update("missing", true)
+	return change
+}
+
+// This returns the changes to a cache's status, oldest first.
+func (f *FinderDB) StatusHistory(cacheCode string) []CacheStatusChange {
+	var changes []CacheStatusChange
+	f.db.Where("cache_code = ?", cacheCode).Order("changed_at, id").Find(&changes)
+	return changes
+}
+
+// This makes sure the cache shows up as updated next time we see it, because we
+// weren't able to read its logs this time.
+func (f *FinderDB) MarkCacheStale(code string) {
+	f.db.Model(&Cache{}).Where("code = ?", code).Update("last_found_time", time.Time{})
+}
+
+// This adds a log to the database and returns its ID. If we've already stored
+// the log it is updated in place instead, so adding the same log twice is harmless.
+// The log's date is taken to be in loc, the time zone of the cache's search area.
+func (f *FinderDB) AddLog(cf *GeocacheLog, gc *Geocache, loc *time.Location) uint {
+	find := CacheFind{
 		Name:      cf.UserName,
-		FindTime:  gc.LastFoundTime,
+		FindTime:  logTime(cf, gc, loc).UTC(),
 		CacheCode: gc.Code,
 		LogString: cf.LogText,
 		FindType:  cf.LogType,
-	})
+		LogTypeID: cf.LogTypeID,
+		LogID:     cf.LogID,
+		LogGUID:   cf.LogGUID,
+		AccountID: cf.AccountID,
+	}
+	if cf.LogID != 0 {
+		var existing CacheFind
+		if tx := f.db.Limit(1).Find(&existing, "log_id = ?", cf.LogID); tx.RowsAffected > 0 {
+			find.Model = existing.Model
+		}
+	}
+	f.db.Save(&find)
+	return find.ID
 }
 
-// This returns the number of finds since local midnight for a given name.
-func (f *FinderDB) FindsSinceMidnight(name string) int {
-	return f.FindsSinceTime(name, time.Now().Truncate(24*time.Hour))
+// This returns when a log says the cache was visited, taking its date to be in
+// loc. Logs only carry a date, so if it's missing or we can't read it we fall back
+// to when the cache was last found.
+func logTime(l *GeocacheLog, gc *Geocache, loc *time.Location) time.Time {
+	for _, date := range []string{l.Visited, l.Created} {
+		if date == "" {
+			continue
+		}
+		if t, err := parseLogDate(date, loc); err == nil {
+			return t
+		}
+	}
+	return gc.LastFoundTime
 }
 
-// This returns the number of finds since local midnight for a given name.
+// This returns true if we've already recorded the given log.
+func (f *FinderDB) HasLog(l *GeocacheLog) bool {
+	var count int64
+	f.db.Model(&CacheFind{}).Where("(log_id = ? AND log_id <> 0) OR (log_guid = ? AND log_guid <> '')", l.LogID, l.LogGUID).Count(&count)
+	return count > 0
+}
+
+// This returns true if we've recorded any logs with IDs for the given cache.
+func (f *FinderDB) HasLogsFor(cacheCode string) bool {
+	var count int64
+	f.db.Model(&CacheFind{}).Where("cache_code = ? AND log_id <> 0", cacheCode).Count(&count)
+	return count > 0
+}
+
+// This returns the number of finds since midnight in the given time zone for a given name.
+func (f *FinderDB) FindsSinceMidnight(name string, loc *time.Location) int {
+	return f.FindsSinceTime(name, midnight(time.Now(), loc))
+}
+
+// This returns the start of t's day in the given time zone.
+func midnight(t time.Time, loc *time.Location) time.Time {
+	y, m, d := t.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// This returns the number of finds since the given time for a given name. Other
+// logs such as DNFs and notes aren't counted.
 func (f *FinderDB) FindsSinceTime(name string, t time.Time) int {
 	var count int64
-	f.db.Model(&CacheFind{}).Where("name = ? AND find_time >= ?", name, t).Count(&count)
+	f.db.Model(&CacheFind{}).Where("name = ? AND find_time >= ? AND find_type IN ?", name, t.UTC(), findLogTypeNames).Count(&count)
 	return int(count)
 }
 
+// This adds a post to the outbox for the given publisher.
+func (f *FinderDB) EnqueuePost(publisher string, post postDetails, now time.Time) error {
+	payload, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+	return f.db.Create(&OutboxPost{
+		Publisher:   publisher,
+		Payload:     string(payload),
+		Status:      outboxPending,
+		NextAttempt: now,
+	}).Error
+}
+
+// This returns the pending posts that are due to be attempted, oldest first.
+func (f *FinderDB) DuePosts(now time.Time) []OutboxPost {
+	var posts []OutboxPost
+	f.db.Where("status = ? AND next_attempt <= ?", outboxPending, now).Order("id").Find(&posts)
+	return posts
+}
+
+// This returns every post that hasn't been delivered yet, whenever it's due.
+func (f *FinderDB) PendingPosts() []OutboxPost {
+	var posts []OutboxPost
+	f.db.Where("status = ?", outboxPending).Order("id").Find(&posts)
+	return posts
+}
+
+// This returns the number of posts that haven't been delivered yet.
+func (f *FinderDB) PendingPostCount() int {
+	var count int64
+	f.db.Model(&OutboxPost{}).Where("status = ?", outboxPending).Count(&count)
+	return int(count)
+}
+
+// This saves the delivery state of an outbox post.
+func (f *FinderDB) SaveOutboxPost(op *OutboxPost) error {
+	return f.db.Save(op).Error
+}
+
+// This records a posted status. Statuses we've already recorded are ignored.
+func (f *FinderDB) RecordPostedStatus(ps *PostedStatus) error {
+	if ps.StatusID != "" {
+		var count int64
+		f.db.Model(&PostedStatus{}).Where("publisher = ? AND status_id = ?", ps.Publisher, ps.StatusID).Count(&count)
+		if count > 0 {
+			return nil
+		}
+	}
+	return f.db.Create(ps).Error
+}
+
+// This returns true if the publisher has already made this kind of post about this
+// user and cache. Statuses read back from the timeline match any kind of post.
+func (f *FinderDB) AlreadyPosted(publisher, cacheCode, userName, kind string) bool {
+	if cacheCode == "" || userName == "" {
+		return false
+	}
+	var statuses []PostedStatus
+	f.db.Where("publisher = ? AND cache_code = ? AND (kind = ? OR kind = '' OR kind IS NULL)", publisher, cacheCode, kind).Find(&statuses)
+	for _, ps := range statuses {
+		if ps.UserName == userName {
+			return true
+		}
+		// A status from the timeline we couldn't match to a finder we know about
+		// might still be about this one.
+		if ps.Kind == "" && ps.UserName == "" && postedFinder(ps.Text) == userName {
+			return true
+		}
+	}
+	return false
+}
+
+// This returns the finder a post is about, which our templates put in quotes
+// before anything else, E.G. In Blerpville, "Amy" just found the "Secret Hideout"
+// geocache! Other names in the post, like "found it with Beepo" in the log text,
+// aren't who it's about. This returns "" if there's nothing quoted.
+func postedFinder(text string) string {
+	start := strings.IndexByte(text, '"')
+	if start < 0 {
+		return ""
+	}
+	end := strings.IndexByte(text[start+1:], '"')
+	if end < 0 {
+		return ""
+	}
+	return text[start+1 : start+1+end]
+}
+
+// This returns everything we've published about a find, oldest first.
+func (f *FinderDB) PostsForFind(cacheFindID uint) []PostedStatus {
+	var statuses []PostedStatus
+	f.db.Where("cache_find_id = ?", cacheFindID).Order("posted_at").Find(&statuses)
+	return statuses
+}
+
+// This returns the ID of the most recent find of the cache by the user, or nil if there isn't one.
+func (f *FinderDB) FindID(cacheCode, userName string) *uint {
+	var find CacheFind
+	if tx := f.db.Where("cache_code = ? AND name = ?", cacheCode, userName).Order("find_time DESC").Limit(1).Find(&find); tx.RowsAffected == 0 {
+		return nil
+	}
+	return &find.ID
+}
+
+// This returns the most recent status from the publisher, posted since the given time,
+// that a new post about this cache or user should be threaded under. It returns nil if
+// there's nothing to reply to.
+func (f *FinderDB) ThreadParent(publisher, cacheCode, userName string, sameCache, sameFinder bool, since time.Time) *PostedStatus {
+	// Posts that aren't about a cache or a finder, like digests and status changes,
+	// mustn't thread together just because they're both missing one.
+	sameCache = sameCache && cacheCode != ""
+	sameFinder = sameFinder && userName != ""
+	if !sameCache && !sameFinder {
+		return nil
+	}
+	tx := f.db.Where("publisher = ? AND status_id != '' AND posted_at >= ?", publisher, since)
+	switch {
+	case sameCache && sameFinder:
+		tx = tx.Where(f.db.Where("cache_code = ?", cacheCode).Or("user_name = ?", userName))
+	case sameCache:
+		tx = tx.Where("cache_code = ?", cacheCode)
+	case sameFinder:
+		tx = tx.Where("user_name = ?", userName)
+	}
+	var parent PostedStatus
+	if tx.Order("posted_at DESC").Limit(1).Find(&parent); parent.ID == 0 {
+		return nil
+	}
+	return &parent
+}
+
+// This returns the names of everyone we have a record of finding a cache.
+func (f *FinderDB) FinderNames(cacheCode string) []string {
+	var names []string
+	f.db.Model(&CacheFind{}).Where("cache_code = ?", cacheCode).Distinct().Pluck("name", &names)
+	return names
+}
+
+// This saves a post to go into the next digest.
+func (f *FinderDB) AddDigestEntry(post postDetails, now time.Time) error {
+	return f.db.Create(&DigestEntry{
+		AreaName:   post.AreaName,
+		Kind:       post.Kind,
+		LogType:    post.LogType,
+		UserName:   post.UserName,
+		CacheName:  post.CacheName,
+		CacheCode:  post.CacheCode,
+		DetailsURL: post.DetailsURL,
+		LogText:    post.LogText,
+		LoggedAt:   now,
+	}).Error
+}
+
+// This returns the entries waiting to go into the area's next digest, oldest first.
+func (f *FinderDB) PendingDigestEntries(areaName string) []DigestEntry {
+	var entries []DigestEntry
+	f.db.Where("area_name = ? AND digested = ?", areaName, false).Order("logged_at").Find(&entries)
+	return entries
+}
+
+// This marks digest entries as having been posted.
+func (f *FinderDB) MarkDigested(entries []DigestEntry) error {
+	var ids []uint
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	return f.db.Model(&DigestEntry{}).Where("id IN ?", ids).Update("digested", true).Error
+}
+
+// This returns true if we've searched the area before.
+func (f *FinderDB) AreaSeeded(areaName string) bool {
+	var count int64
+	f.db.Model(&SearchArea{}).Where("area_name = ?", areaName).Count(&count)
+	return count > 0
+}
+
+// This returns true if we've recorded searching any area at all.
+func (f *FinderDB) AnyAreaSeeded() bool {
+	var count int64
+	f.db.Model(&SearchArea{}).Count(&count)
+	return count > 0
+}
+
+// This records that we've searched the area.
+func (f *FinderDB) MarkAreaSeeded(areaName string) error {
+	return f.db.Where(SearchArea{AreaName: areaName}).FirstOrCreate(&SearchArea{}).Error
+}
+
 func NewFinderDB(filename string) (*FinderDB, error) {
 	fdb := &FinderDB{}
 	if err := fdb.Init(filename); err != nil {
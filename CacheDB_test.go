@@ -24,12 +24,20 @@ func getTestData(finderName string, findTime time.Time, cacheCode string, logTex
 		LastFoundTime: findTime,
 	}
 	l := GeocacheLog{
-		UserName: finderName,
-		LogText:  logText,
+		UserName:  finderName,
+		LogText:   logText,
+		LogTypeID: 2,
+		LogType:   "Found it",
 	}
 	return &l, &gc
 }
 
+// Adds a log filled with the provided test data, with its date in UTC
+func addTestLog(db *FinderDB, finderName string, findTime time.Time, cacheCode string, logText string) uint {
+	l, gc := getTestData(finderName, findTime, cacheCode, logText)
+	return db.AddLog(l, gc, time.UTC)
+}
+
 func TestAddLog(t *testing.T) {
 	tempdir := t.TempDir()
 	// Set the "current time" to midday so we don't run into issues with the midnight rollover.
@@ -42,22 +50,30 @@ func TestAddLog(t *testing.T) {
 	} else {
 		defer db.Close()
 		// Add a find from right now
-		db.AddLog(getTestData("testname", timeNow, "GC123", "testlog"))
+		addTestLog(db, "testname", timeNow, "GC123", "testlog")
 		// Check one find in the last 24 hours.
 		if want, got := 1, db.FindsSinceTime("testname", timeMidnight); want != got {
 			t.Fatalf("FindsSinceMidnight returned wrong value: want %d, got %d", want, got)
 		}
 		// Add an irrelevant find.
-		db.AddLog(getTestData("testname2", timeNow, "GC321", "testlog"))
+		addTestLog(db, "testname2", timeNow, "GC321", "testlog")
 
 		// Add another find ten minutes ago
-		db.AddLog(getTestData("testname", timeNow.Add(-10*time.Minute), "GC456", "testlog2"))
+		addTestLog(db, "testname", timeNow.Add(-10*time.Minute), "GC456", "testlog2")
 		// Check we now have two finds since midnight
 		if want, got := 2, db.FindsSinceTime("testname", timeMidnight); want != got {
 			t.Fatalf("FindsSinceMidnight returned wrong value: want %d, got %d", want, got)
 		}
+		// Add a DNF and ensure it doesn't count as a find
+		dnf, gc := getTestData("testname", timeNow, "GC999", "no luck")
+		dnf.LogTypeID = 3
+		dnf.LogType = "Didn't find it"
+		db.AddLog(dnf, gc, time.UTC)
+		if want, got := 2, db.FindsSinceTime("testname", timeMidnight); want != got {
+			t.Fatalf("FindsSinceMidnight returned wrong value: want %d, got %d", want, got)
+		}
 		// Add a find 24 hours ago and ensure it doesn't count towards today's finds
-		db.AddLog(getTestData("testname", timeNow.Add(-24*time.Hour), "GC789", "testlog3"))
+		addTestLog(db, "testname", timeNow.Add(-24*time.Hour), "GC789", "testlog3")
 		if want, got := 2, db.FindsSinceTime("testname", timeMidnight); want != got {
 			t.Fatalf("FindsSinceMidnight returned wrong value: want %d, got %d", want, got)
 		}
@@ -80,7 +96,7 @@ func TestPersistence(t *testing.T) {
 		t.Fatal(err)
 	} else {
 		defer db.Close()
-		db.AddLog(getTestData("testname", timeNow, "GC123", "testlog"))
+		addTestLog(db, "testname", timeNow, "GC123", "testlog")
 		db.UpdateCache(&gc)
 	}
 	if db, err := NewFinderDB(tempdir + "/test.sqlite3"); err != nil {
@@ -205,3 +221,102 @@ func TestLastPostedFoundTimeDefault(t *testing.T) {
 		}
 	}
 }
+
+func TestAddLogIdempotent(t *testing.T) {
+	tempdir := t.TempDir()
+	db, err := NewFinderDB(tempdir + "/test.sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, gc := getTestData("testname", time.Now(), "GC123", "testlog")
+	l.LogID = 42
+	l.AccountID = 1234
+	l.Visited = "3/16/2023"
+	brisbane := time.FixedZone("AEST", 10*60*60)
+	id := db.AddLog(l, gc, brisbane)
+
+	// Adding the same log again, say after it was edited, updates it rather than adding another.
+	l.LogText = "edited"
+	if want, got := id, db.AddLog(l, gc, brisbane); want != got {
+		t.Errorf("Expected the log to keep ID %d, got %d", want, got)
+	}
+	var finds []CacheFind
+	db.db.Find(&finds)
+	if want, got := 1, len(finds); want != got {
+		t.Fatalf("Expected %d logs, got %d", want, got)
+	}
+	if want, got := "edited", finds[0].LogString; want != got {
+		t.Errorf("Expected the log text to be %q, got %q", want, got)
+	}
+	if want, got := 1234, finds[0].AccountID; want != got {
+		t.Errorf("Expected the account ID to be %d, got %d", want, got)
+	}
+	// The find time comes from the log, not the cache.
+	if want, got := time.Date(2023, 3, 16, 0, 0, 0, 0, brisbane), finds[0].FindTime; !want.Equal(got) {
+		t.Errorf("Expected the find time to be %s, got %s", want, got)
+	}
+	if want, got := 1, db.FindsSinceTime("testname", time.Date(2023, 3, 15, 0, 0, 0, 0, time.UTC)); want != got {
+		t.Errorf("Expected %d finds, got %d", want, got)
+	}
+
+	// Duplicates stored before the unique index existed are cleaned up when the DB is opened.
+	db.db.Exec("DROP INDEX idx_cache_finds_log_id_unique")
+	db.db.Create(&CacheFind{Name: "testname", LogID: 42})
+	db.db.Create(&CacheFind{Name: "testname", LogID: 43})
+	db.Close()
+	if db, err = NewFinderDB(tempdir + "/test.sqlite3"); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int64
+	db.db.Model(&CacheFind{}).Where("log_id = ?", 42).Count(&count)
+	if want, got := int64(1), count; want != got {
+		t.Errorf("Expected %d copies of the log, got %d", want, got)
+	}
+	if err := db.db.Create(&CacheFind{Name: "testname", LogID: 43}).Error; err == nil {
+		t.Errorf("Expected the unique index to stop a duplicate log being stored")
+	}
+}
+
+func TestAlreadyPosted(t *testing.T) {
+	tempdir := t.TempDir()
+	db, err := NewFinderDB(tempdir + "/test.sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Bob and Amy found the cache together, and Bob's log mentions Amy.
+	db.RecordPostedStatus(&PostedStatus{
+		Publisher: "m",
+		StatusID:  "1",
+		CacheCode: "GC1",
+		UserName:  "Bob",
+		Kind:      kindFind,
+		Text:      `"Bob" just found the "Secret Hideout" geocache! TFTC, found it with Amy`,
+	})
+	if !db.AlreadyPosted("m", "GC1", "Bob", kindFind) {
+		t.Errorf("Expected Bob's find to have been posted")
+	}
+	if db.AlreadyPosted("m", "GC1", "Amy", kindFind) {
+		t.Errorf("Expected Amy's find not to have been posted")
+	}
+
+	// Statuses from the timeline are matched on the finder named in their text,
+	// not anyone else it mentions.
+	db.RecordPostedStatus(&PostedStatus{
+		Publisher: "m",
+		StatusID:  "2",
+		CacheCode: "GC2",
+		Text:      `In Blerpville, "Amylee" just found the "Bingo Hall" geocache! They wrote: "Found it with Beepo"`,
+	})
+	if !db.AlreadyPosted("m", "GC2", "Amylee", kindFind) {
+		t.Errorf("Expected Amylee's find to have been posted")
+	}
+	if db.AlreadyPosted("m", "GC2", "Amy", kindFind) {
+		t.Errorf("Expected Amy's find not to have been posted")
+	}
+	if db.AlreadyPosted("m", "GC2", "Beepo", kindFind) {
+		t.Errorf("Expected Beepo's find not to have been posted")
+	}
+}
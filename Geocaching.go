@@ -1,37 +1,54 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"math"
 	"os"
+	"text/template"
+	"time"
 
-	"github.com/dustin/go-humanize"
 	log "github.com/sirupsen/logrus"
 )
 
 type GeocachingAPIer interface {
-	Auth(clientID, clientSecret string) error
-	Search(st searchTerms) ([]Geocache, error)
-	GetLogs(geocache *Geocache) ([]GeocacheLog, error)
+	Auth(ctx context.Context, clientID, clientSecret string) error
+	Search(ctx context.Context, st searchTerms) ([]Geocache, error)
+	GetLogs(ctx context.Context, geocache *Geocache, seen func(*GeocacheLog) bool) ([]GeocacheLog, error)
 }
 
 type Geocaching struct {
-	api  GeocachingAPIer
-	db   *FinderDB
-	conf configStore
+	api   GeocachingAPIer
+	db    *FinderDB
+	conf  configStore
+	areas []searchTerms
+	// These are only used to work out how many entries fit in a digest post.
+	templates *template.Template
 }
 
-func NewGeocaching(conf configStore, api GeocachingAPIer) (*Geocaching, error) {
+func NewGeocaching(ctx context.Context, conf configStore, api GeocachingAPIer) (*Geocaching, error) {
 	var err error
 	g := &Geocaching{}
 	g.conf = conf
+	g.areas = append([]searchTerms{}, conf.searchAreas()...)
+	for i := range g.areas {
+		if err = g.areas[i].loadBoundary(); err != nil {
+			return nil, err
+		}
+		if err = g.areas[i].loadTimeZone(); err != nil {
+			return nil, err
+		}
+	}
+	if g.templates, err = conf.Templates.compile(); err != nil {
+		return nil, err
+	}
 	g.api = api
-	if err = g.api.Auth(os.Getenv("GEOCACHING_CLIENT_ID"), os.Getenv("GEOCACHING_CLIENT_SECRET")); err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+	if err = g.api.Auth(ctx, os.Getenv("GEOCACHING_CLIENT_ID"), os.Getenv("GEOCACHING_CLIENT_SECRET")); err != nil {
+		return nil, err
 	}
 	g.db, err = NewFinderDB(conf.DBFilename)
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	return g, nil
@@ -41,101 +58,403 @@ func (g *Geocaching) Close() {
 	g.db.Close()
 }
 
-// This polls the API for a list of geocaches and updates our database
-// with the results. It returns a slice of postDetails containing the
-// information necessary to produce a post about the cache.
-func (g *Geocaching) Update() ([]postDetails, error) {
+// This is a cache from a search, along with every search area it was found in.
+type areaCache struct {
+	cache Geocache
+	areas []*searchTerms
+}
+
+// This polls the API for a list of geocaches in each search area and updates
+// our database with the results. It returns a slice of postDetails containing
+// the information necessary to produce a post about the cache. A cache in more
+// than one area is only posted about once, under the first area it's in. If
+// gc.com is rate limiting us or has logged us out, or ctx is cancelled, it
+// stops early, returning the posts it has built so far along with the error.
+func (g *Geocaching) Update(ctx context.Context) ([]postDetails, error) {
 	var results []postDetails
+	db := g.db.WithContext(ctx)
 
-	caches, err := g.api.Search(g.conf.SearchTerms)
-	if err != nil {
-		return results, err
+	// Databases from before we had more than one area don't record which areas
+	// they've seen. Assume they've seen the first one, and record that so it
+	// still counts once more areas are added.
+	if db.CacheCount() > 0 && !db.AnyAreaSeeded() && len(g.areas) > 0 {
+		if err := db.MarkAreaSeeded(g.areas[0].AreaName); err != nil {
+			log.Error(err)
+		}
+	}
+	var found []*areaCache
+	byCode := make(map[string]*areaCache)
+	firstRun := make(map[*searchTerms]bool)
+	// Every cache in every search, filtered out or not, so we can tell if one disappears.
+	seen := make(map[string]bool)
+	searchFailed := false
+	for i := range g.areas {
+		area := &g.areas[i]
+		caches, err := g.search(ctx, area)
+		switch {
+		case errors.Is(err, ErrRateLimited), errors.Is(err, ErrNotAuthenticated), err != nil && ctx.Err() != nil:
+			return results, err
+		case err != nil:
+			// The other areas might still work.
+			log.Error("Searching ", area.AreaName, ": ", err)
+			searchFailed = true
+			continue
+		}
+		for _, cache := range caches {
+			seen[cache.Code] = true
+		}
+		caches = area.Filters.filter(caches)
+		log.Println("Found", len(caches), "geocaches in", area.AreaName)
+		// If we've never searched an area before then every cache in it is "new".
+		// Record them all quietly rather than announcing hundreds of caches that
+		// were published years ago.
+		firstRun[area] = !db.AreaSeeded(area.AreaName)
+		if firstRun[area] {
+			log.Println("First search of", area.AreaName, "recording", len(caches), "geocaches without posting")
+		}
+		for _, cache := range caches {
+			if ac, ok := byCode[cache.Code]; ok {
+				ac.areas = append(ac.areas, area)
+				continue
+			}
+			ac := &areaCache{cache: cache, areas: []*searchTerms{area}}
+			byCode[cache.Code] = ac
+			found = append(found, ac)
+		}
 	}
-	log.Println("Found", len(caches), "geocaches")
-	for _, cache := range caches {
-		new, updated := g.db.UpdateCache(&cache)
-		if !new && !updated {
+
+	for _, ac := range found {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		cache := ac.cache
+		new, updated := db.UpdateCache(&cache)
+		// Only announce things in the areas we've searched before.
+		var areas []*searchTerms
+		for _, area := range ac.areas {
+			if !firstRun[area] {
+				areas = append(areas, area)
+			}
+		}
+		if len(areas) == 0 && !new {
+			areas = ac.areas
+		}
+		if change := db.UpdateCacheStatus(&cache, ac.areas[0].AreaName, time.Now().UTC()); change != nil && len(areas) > 0 {
+			results = g.dispatch(db, g.statusChangePost(areas[0], &cache, change), areas, results)
+		}
+		if (!new && !updated) || len(areas) == 0 {
 			continue
 		}
-		if post, err := g.buildPostDetails(&cache, new, updated); err == nil {
-			results = append(results, post)
-		} else {
+		posts, err := g.buildPostDetails(ctx, areas[0], &cache, new, updated)
+		switch {
+		case errors.Is(err, ErrPremiumOnly):
+			// There's no point trying again, we'll never be able to read its logs.
+			log.Debug(err)
+			continue
+		case errors.Is(err, ErrRateLimited), errors.Is(err, ErrNotAuthenticated), err != nil && ctx.Err() != nil:
+			// Every other cache will fail the same way, so stop here and pick up
+			// where we left off next time. This can't use ctx, it may be cancelled.
+			g.db.MarkCacheStale(cache.Code)
+			return results, err
+		case err != nil:
 			log.Error(err)
+			db.MarkCacheStale(cache.Code)
+			continue
+		}
+		for _, post := range posts {
+			results = g.dispatch(db, post, areas, results)
+		}
+	}
+	if !searchFailed {
+		results = g.findMissing(db, seen, results)
+	}
+	for i := range g.areas {
+		area := &g.areas[i]
+		if firstRun[area] {
+			if err := db.MarkAreaSeeded(area.AreaName); err != nil {
+				log.Error(err)
+			}
 		}
+		results = append(results, g.buildDigests(ctx, area, time.Now().UTC())...)
 	}
 	return results, nil
 }
 
-// This truncates a string to the given maximum length and returns
-// the result. If truncation was necessary, it adds an elipsis to
-// the end of the string.
-func truncate(s string, max int) string {
-	if len(s) >= max {
-		return s[:max-4] + "…\""
+// This does whatever the config says to do with a post about a cache in the
+// given areas, returning results with the post added if it's to be posted now.
+func (g *Geocaching) dispatch(db *FinderDB, post postDetails, areas []*searchTerms, results []postDetails) []postDetails {
+	post.Publishers = areaPublishers(areas)
+	switch g.conf.logTypePolicy(post.Kind) {
+	case policyPost:
+		results = append(results, post)
+	case policyDigest:
+		if err := db.AddDigestEntry(post, time.Now().UTC()); err != nil {
+			log.Error(err)
+		}
+	default:
+		log.Debug("Not posting ", post.Kind, " on ", post.CacheCode, " by ", post.UserName)
+	}
+	return results
+}
+
+// More than this many caches disappearing at once is more likely to be a change
+// to the config, or gc.com having a bad day, than a spate of archiving.
+const maxMissingCaches = 20
+
+// This records the caches that have stopped showing up in our searches, and
+// returns results with posts about them added. seen holds the codes of every
+// cache in this round of searches.
+func (g *Geocaching) findMissing(db *FinderDB, seen map[string]bool, results []postDetails) []postDetails {
+	missing := db.UnseenCaches(seen)
+	if len(missing) > maxMissingCaches {
+		log.Warn(len(missing), " geocaches are missing from our searches, assuming they'll be back")
+		return results
+	}
+	for i := range missing {
+		cache := &missing[i]
+		log.Println(cache.Code, "is missing from our searches")
+		change := db.MarkCacheMissing(cache, time.Now().UTC())
+		// If the area it was in has been removed from the config we've nowhere to post it.
+		for j := range g.areas {
+			area := &g.areas[j]
+			if area.AreaName == cache.AreaName {
+				gc := &Geocache{Code: cache.Code, Name: cache.Name, CacheStatus: cache.Status, DetailsURL: "/geocache/" + cache.Code}
+				results = g.dispatch(db, g.statusChangePost(area, gc, change), []*searchTerms{area}, results)
+				break
+			}
+		}
+	}
+	return results
+}
+
+// This builds a post about a change to a cache's status.
+func (g *Geocaching) statusChangePost(area *searchTerms, gc *Geocache, change *CacheStatusChange) postDetails {
+	cache := *gc
+	return postDetails{
+		AreaName:       area.AreaName,
+		CacheName:      gc.Name,
+		CacheCode:      gc.Code,
+		DetailsURL:     "https://www.geocaching.com" + gc.DetailsURL,
+		PremiumOnly:    gc.PremiumOnly,
+		Kind:           change.Kind,
+		LogType:        statusChangeDescriptions[change.Kind],
+		PreviousStatus: change.From,
+		Geocache:       &cache,
 	}
-	return s
+}
+
+// This returns the caches inside the area. Areas with a boundary might take
+// more than one search to cover.
+func (g *Geocaching) search(ctx context.Context, area *searchTerms) ([]Geocache, error) {
+	if len(area.boundary) == 0 {
+		return g.api.Search(ctx, *area)
+	}
+	var caches []Geocache
+	seen := make(map[string]bool)
+	for _, circle := range area.searchCircles() {
+		found, err := g.api.Search(ctx, circle)
+		if err != nil {
+			return nil, err
+		}
+		for i := range found {
+			if !seen[found[i].Code] && area.inBoundary(&found[i]) {
+				seen[found[i].Code] = true
+				caches = append(caches, found[i])
+			}
+		}
+	}
+	return caches, nil
+}
+
+// This returns the publishers posts about caches in the given areas go to. If
+// any of the areas goes to every publisher this returns nil, meaning all of them.
+func areaPublishers(areas []*searchTerms) []string {
+	var publishers []string
+	seen := make(map[string]bool)
+	for _, area := range areas {
+		if len(area.Publishers) == 0 {
+			return nil
+		}
+		for _, p := range area.Publishers {
+			if !seen[p] {
+				seen[p] = true
+				publishers = append(publishers, p)
+			}
+		}
+	}
+	return publishers
+}
+
+// This returns digest posts of the logs we've been saving up in an area, if
+// they're due. A digest is due once the day its oldest entry was saved on is
+// over, in the area's time zone, so there's at most one a day. The entries are
+// split over as many posts as it takes for them all to fit, so none are lost
+// when the post is shortened.
+func (g *Geocaching) buildDigests(ctx context.Context, area *searchTerms, now time.Time) []postDetails {
+	db := g.db.WithContext(ctx)
+	entries := db.PendingDigestEntries(area.AreaName)
+	if len(entries) == 0 || now.Before(midnight(entries[0].LoggedAt, area.timeZone()).AddDate(0, 0, 1)) {
+		return nil
+	}
+	if err := db.MarkDigested(entries); err != nil {
+		log.Error(err)
+		return nil
+	}
+	maxLength := g.digestLength(area)
+	var digests []postDetails
+	for len(entries) > 0 {
+		// Every post gets at least one entry, even if it has to be shortened.
+		digest := postDetails{
+			AreaName:   area.AreaName,
+			Kind:       kindDigest,
+			Digest:     entries[:1],
+			Publishers: area.Publishers,
+		}
+		for n := 2; n <= len(entries); n++ {
+			candidate := digest
+			candidate.Digest = entries[:n]
+			text, err := candidate.render(g.templates, math.MaxInt32)
+			if err != nil || mastodonLength(text) > maxLength {
+				break
+			}
+			digest = candidate
+		}
+		digests = append(digests, digest)
+		entries = entries[len(digest.Digest):]
+	}
+	return digests
+}
+
+// This returns the longest a digest post for the area can be, which is the
+// shortest maximum length of the publishers it goes to.
+func (g *Geocaching) digestLength(area *searchTerms) int {
+	maxLength := math.MaxInt32
+	for _, p := range g.conf.Publishers {
+		if len(area.Publishers) > 0 && !contains(area.Publishers, p.Name) {
+			continue
+		}
+		if p.MaxLength == 0 {
+			p.MaxLength = mastodonDefaultMaxLength
+		}
+		if p.MaxLength < maxLength {
+			maxLength = p.MaxLength
+		}
+	}
+	if maxLength == math.MaxInt32 {
+		return mastodonDefaultMaxLength
+	}
+	return maxLength
 }
 
 type postDetails struct {
 	AreaName        string
 	UserName        string
 	CacheName       string
+	CacheCode       string
 	DetailsURL      string
 	UsersFindsToday int
 	LogText         string
+	LogType         string
+	Kind            string // The kind of post, which picks the template. See logtypes.go.
+	FinderFindCount int    // The finder's total number of finds, including this one.
 	NewCache        bool
 	PremiumOnly     bool
-}
+	CacheFindID     uint   // The CacheFind this post is about, if any.
+	InReplyToID     string `json:"-"` // The status this should be posted as a reply to. This is set per-publisher.
+	// The publishers this should go to, from the search area's config. Empty means all of them.
+	Publishers []string `json:"-"`
 
-func (p *postDetails) toString() string {
-	message := ""
-	if !p.NewCache {
-		message += "In " + p.AreaName + ", \"" + p.UserName + "\""
-		message += " just found the \"" + p.CacheName + "\""
-		if p.PremiumOnly {
-			message += " premium"
-		}
-		message += " geocache! " + p.DetailsURL
-		if p.UsersFindsToday > 1 {
-			message += " That's their " + humanize.Ordinal(p.UsersFindsToday) + " find today!"
-		}
-		message += " They wrote: \"" + p.LogText + "\""
-	}
-	geocachingHashtagString := " #geocaching"
-	message = truncate(message, 500-len(geocachingHashtagString))
-	message += geocachingHashtagString
-	return message
+	// These are only populated for new caches.
+	CacheType     string
+	ContainerType string
+	Difficulty    float64
+	Terrain       float64
+	PlacedDate    time.Time
+
+	// This is only populated for changes to a cache's status. The new status is in Geocache.
+	PreviousStatus CacheStatus
+
+	// This is only populated for digests.
+	Digest []DigestEntry `json:",omitempty"`
+
+	// The raw data the post was built from, for publishers that want more detail.
+	Geocache *Geocache    `json:",omitempty"`
+	Log      *GeocacheLog `json:",omitempty"`
 }
 
-func (g *Geocaching) buildPostDetails(gc *Geocache, new, updated bool) (postDetails, error) {
+// This builds the posts for a cache that is new or has been updated. A new cache
+// gets a single post, and an updated cache gets one post per log we haven't seen
+// before, oldest first. A cache only counts as updated when its last found date
+// changes, since that's all a search tells us. Logs that aren't finds, like DNFs,
+// maintenance and archive logs, don't change it, so they're only picked up the
+// next time someone finds the cache, which might be weeks later.
+func (g *Geocaching) buildPostDetails(ctx context.Context, area *searchTerms, gc *Geocache, new, updated bool) ([]postDetails, error) {
 	var err error
 	var result postDetails
-	result.AreaName = g.conf.SearchTerms.AreaName
+	result.AreaName = area.AreaName
 	result.CacheName = gc.Name
+	result.CacheCode = gc.Code
 	result.DetailsURL = "https://www.geocaching.com" + gc.DetailsURL
 	result.PremiumOnly = gc.PremiumOnly
+	cache := *gc
+	result.Geocache = &cache
 	if new {
 		// If the cache is new, don't bother trying to get the find logs for it.
 		result.UserName = gc.Owner.Username
 		result.UsersFindsToday = 0
 		result.LogText = ""
 		result.NewCache = true
-	} else if updated {
-		// If the cache was updated, get the latest log and add it to the database.
-		var logs []GeocacheLog
-		if logs, err = g.GetLogs(gc); err != nil {
-			return result, err
+		result.Kind = kindNewCache
+		result.CacheType = gc.GeocacheType.Name(g.conf.Language)
+		result.ContainerType = gc.ContainerType.Name(g.conf.Language)
+		result.Difficulty = gc.Difficulty
+		result.Terrain = gc.Terrain
+		if gc.PlacedDate != "" {
+			if result.PlacedDate, err = parseTime(gc.PlacedDate, area.timeZone()); err != nil {
+				log.Debug("Couldn't parse placed date for ", gc.Code, ": ", err)
+			}
 		}
-		g.db.AddLog(&logs[0], gc)
-
-		result.UserName = logs[0].UserName
-		result.UsersFindsToday = g.db.FindsSinceMidnight(logs[0].UserName)
-		result.LogText = logs[0].LogText
-		result.NewCache = false
+		return []postDetails{result}, nil
+	}
+	if !updated {
+		return nil, nil
 	}
-	return result, nil
+	// If the cache was updated, get the logs we haven't seen and add them to the database.
+	logs, err := g.GetLogs(ctx, gc)
+	if err != nil {
+		return nil, err
+	}
+	db := g.db.WithContext(ctx)
+	var results []postDetails
+	for i := range logs {
+		post := result
+		l := logs[i]
+		post.CacheFindID = db.AddLog(&l, gc, area.timeZone())
+		post.UserName = l.UserName
+		post.UsersFindsToday = db.FindsSinceMidnight(l.UserName, area.timeZone())
+		post.LogText = l.LogText
+		post.LogType = l.LogType
+		post.Kind = logKind(&l)
+		post.FinderFindCount = l.GeocacheFindCount
+		post.NewCache = false
+		post.Log = &l
+		results = append(results, post)
+	}
+	return results, nil
 }
 
-func (g *Geocaching) GetLogs(geocache *Geocache) ([]GeocacheLog, error) {
-	return g.api.GetLogs(geocache)
+// This returns the logs on a geocache that we haven't recorded yet, oldest first.
+// If we've never recorded a log for the cache, or none of the ones we recorded are
+// in the logbook any more, we've no way of telling how far back to look, so we
+// only return the newest one.
+func (g *Geocaching) GetLogs(ctx context.Context, geocache *Geocache) ([]GeocacheLog, error) {
+	db := g.db.WithContext(ctx)
+	if !db.HasLogsFor(geocache.Code) {
+		logs, err := g.api.GetLogs(ctx, geocache, nil)
+		if len(logs) > 1 {
+			logs = logs[len(logs)-1:]
+		}
+		return logs, err
+	}
+	return g.api.GetLogs(ctx, geocache, db.HasLog)
 }
@@ -3,20 +3,20 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"io"
-	"math/rand"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/time/rate"
 
 	"github.com/microcosm-cc/bluemonday"
 )
@@ -24,14 +24,22 @@ import (
 type GeocachingAPI struct {
 	config           APIConfig
 	client           *RLHTTPClient
-	cookieJar        *cookiejar.Jar
+	cookieJar        *persistentJar
 	blueMondayPolicy *bluemonday.Policy
+	tiles            *tileCache
+	searchLimit      int // The most results we'll page through in one search.
+
+	// These are kept so we can log in again when our session expires.
+	clientID     string
+	clientSecret string
+	authFailures int       // How many times in a row logging in again has failed.
+	nextAuth     time.Time // We won't try logging in again before this.
 }
 
 func NewGeocachingAPI(c APIConfig) (*GeocachingAPI, error) {
 	var err error
 	g := &GeocachingAPI{config: c}
-	g.cookieJar, err = cookiejar.New(nil)
+	g.cookieJar, err = newPersistentJar(c.GeocachingAPIURL)
 	if err != nil {
 		return nil, err
 	}
@@ -44,33 +52,89 @@ func NewGeocachingAPI(c APIConfig) (*GeocachingAPI, error) {
 		}
 	}
 
-	var limiter *rate.Limiter
+	interval := 1 * time.Second
+	if c.UnThrottle {
+		interval = 0
+	}
+	g.client = NewRLHTTPClient(&http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)},
+		Jar:       g.cookieJar,
+		Timeout:   time.Duration(c.RequestTimeoutSeconds) * time.Second,
+	}, interval)
+	g.blueMondayPolicy = bluemonday.StrictPolicy()
+	g.tiles = newTileCache(c.TileFile)
+	g.searchLimit = maxSearchResults
+	return g, nil
+}
 
-	if !c.UnThrottle {
-		limiter = rate.NewLimiter(rate.Every(1*time.Second), 1)
-	} else {
-		limiter = rate.NewLimiter(rate.Inf, 1)
+// This logs in to gc.com. If we saved a session last time we ran and it still
+// works we carry on using it instead, since logging in on every restart is the
+// sort of thing that gets accounts flagged.
+func (g *GeocachingAPI) Auth(ctx context.Context, clientID, clientSecret string) error {
+	g.clientID = clientID
+	g.clientSecret = clientSecret
+	if g.resumeSession(ctx) {
+		log.Println("Resumed our saved session with", g.config.GeocachingAPIURL)
+		return nil
+	}
+	return g.login(ctx, clientID, clientSecret)
+}
+
+// This is a cheap page that bounces us to the sign in page if we're not logged in.
+const sessionCheckPath = "/account/settings/profile"
+
+// This loads the saved session, if there is one, and checks it's still logged in.
+func (g *GeocachingAPI) resumeSession(ctx context.Context) bool {
+	if g.config.CookieFile == "" {
+		return false
+	}
+	n, err := g.cookieJar.Load(g.config.CookieFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("Couldn't load our saved session: ", err)
+		}
+		return false
+	}
+	if n == 0 {
+		return false
 	}
+	req, err := http.NewRequestWithContext(ctx, "GET", g.config.GeocachingAPIURL+sessionCheckPath, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:109.0) Gecko/20100101 Firefox/110.0")
+	log.Debug("Request: Session check")
+	resp, body, err := g.doRead(req)
+	if err != nil {
+		log.Warn("Couldn't check our saved session: ", err)
+		return false
+	}
+	if resp.StatusCode != http.StatusOK || loggedOut(resp, body, false) {
+		log.Println("Our saved session has expired")
+		return false
+	}
+	return true
+}
 
-	g.client = &RLHTTPClient{
-		client: &http.Client{
-			Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)},
-			Jar:       g.cookieJar,
-		},
-		Ratelimiter: limiter,
+// This saves our session so we can pick it up again after a restart. It's saved
+// after logging in, and again whenever gc.com changes our cookies.
+func (g *GeocachingAPI) saveSession() {
+	if g.config.CookieFile == "" {
+		return
+	}
+	if err := g.cookieJar.Save(g.config.CookieFile); err != nil {
+		log.Warn("Couldn't save our session: ", err)
 	}
-	g.blueMondayPolicy = bluemonday.StrictPolicy()
-	return g, nil
 }
 
 // Broadly copying from https://github.com/btittelbach/gctools/blob/master/geocachingsitelib.py and
 // https://github.com/cgeo/cgeo/blob/master/main/src/main/java/cgeo/geocaching/connector/gc/GCWebAPI.java
-func (g *GeocachingAPI) Auth(clientID, clientSecret string) error {
+func (g *GeocachingAPI) login(ctx context.Context, clientID, clientSecret string) error {
 	var err error
 
 	// First we have to initiate a request to https://www.geocaching.com/account/signin
 	// to obtain a "__RequestVerificationToken" value.
-	RVTReq, err := http.NewRequest("GET", g.config.GeocachingAPIURL+"/account/signin", nil)
+	RVTReq, err := http.NewRequestWithContext(ctx, "GET", g.config.GeocachingAPIURL+"/account/signin", nil)
 	if err != nil {
 		return err
 	}
@@ -104,7 +168,7 @@ func (g *GeocachingAPI) Auth(clientID, clientSecret string) error {
 	params.Add("Password", clientSecret)
 	body := strings.NewReader(params.Encode())
 
-	POSTReq, err := http.NewRequest("POST", g.config.GeocachingAPIURL+"/account/signin", body)
+	POSTReq, err := http.NewRequestWithContext(ctx, "POST", g.config.GeocachingAPIURL+"/account/signin", body)
 	if err != nil {
 		return err
 	}
@@ -133,20 +197,179 @@ func (g *GeocachingAPI) Auth(clientID, clientSecret string) error {
 		if match, err := regexp.Match("It seems your Anti-Forgery Token is invalid", body); err == nil && match {
 			return fmt.Errorf("Anti-Forgery Token is invalid")
 		}
-		// if match, err := regexp.Match(`"isLoggedIn": true,`, body); err != nil || !match {
-		// 	// Print the body
-		// 	log.Println(string(body))
-		// 	return fmt.Errorf("login failed")
-		// }
+		if match, err := regexp.Match(`"isLoggedIn":\s*true`, body); err != nil || !match {
+			log.Debug(string(body))
+			return fmt.Errorf("login failed")
+		}
 
 	} else {
 		return fmt.Errorf("couldn't read body")
 	}
 
 	log.Println("Authenticated to", g.config.GeocachingAPIURL)
+	g.saveSession()
 	return nil
 }
 
+// These are the errors GeocachingAPI returns when gc.com doesn't give us what we
+// asked for. They're usually wrapped with more detail, so check them with errors.Is.
+var (
+	// gc.com told us to slow down.
+	ErrRateLimited = errors.New("rate limited by gc.com")
+	// We couldn't get a logged in response from gc.com, even after logging in again.
+	ErrNotAuthenticated = errors.New("not logged in to gc.com")
+	// The geocache is premium only, and we can't see its details.
+	ErrPremiumOnly = errors.New("premium only geocache")
+	// gc.com returned an error, or something we couldn't make sense of.
+	ErrUpstream = errors.New("unexpected response from gc.com")
+)
+
+// This returns an error for responses we can't use, regardless of whether we're
+// logged in. Logged out responses are dealt with by doAuthenticated.
+func checkResponse(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+			return fmt.Errorf("%w, retry after %s", ErrRateLimited, retryAfter)
+		}
+		return ErrRateLimited
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("%w: %s from %s", ErrUpstream, resp.Status, resp.Request.URL.Path)
+	}
+	return nil
+}
+
+// This returns an error if a response that should be JSON isn't.
+func checkJSON(resp *http.Response, body []byte) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %s from %s", ErrUpstream, resp.Status, resp.Request.URL.Path)
+	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return fmt.Errorf("%w: expected JSON from %s, got %q", ErrUpstream, resp.Request.URL.Path, resp.Header.Get("Content-Type"))
+	}
+	return nil
+}
+
+// How long we wait before trying to log in again after it fails. This doubles
+// with each failure, up to authBackoffMax.
+const (
+	authBackoffBase = time.Minute
+	authBackoffMax  = time.Hour
+)
+
+// This logs in again using the credentials Auth was last called with. If
+// logging in keeps failing we back off rather than hammering the login page.
+func (g *GeocachingAPI) reauth(ctx context.Context) error {
+	if g.clientID == "" {
+		return ErrNotAuthenticated
+	}
+	if wait := time.Until(g.nextAuth); wait > 0 {
+		return fmt.Errorf("%w, not trying to log in again for %s", ErrNotAuthenticated, wait.Round(time.Second))
+	}
+	if err := g.login(ctx, g.clientID, g.clientSecret); err != nil {
+		g.authFailures++
+		backoff := authBackoffBase << (g.authFailures - 1)
+		if backoff > authBackoffMax || backoff <= 0 {
+			backoff = authBackoffMax
+		}
+		g.nextAuth = time.Now().Add(backoff)
+		return fmt.Errorf("%w: %s", ErrNotAuthenticated, err)
+	}
+	g.authFailures = 0
+	return nil
+}
+
+// This returns true if a response looks like gc.com has logged us out. We either
+// get bounced to the sign in page, get a 401 or 403, or get a HTML page where we
+// were expecting JSON.
+func loggedOut(resp *http.Response, body []byte, wantJSON bool) bool {
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return true
+	}
+	if resp.Request != nil && strings.HasPrefix(strings.ToLower(resp.Request.URL.Path), "/account/signin") {
+		return true
+	}
+	if wantJSON {
+		if strings.Contains(resp.Header.Get("Content-Type"), "text/html") {
+			return true
+		}
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '<' {
+			return true
+		}
+	}
+	return false
+}
+
+// This sends a request and returns the response along with its body, unzipped
+// if necessary. The response body has already been closed.
+func (g *GeocachingAPI) doRead(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if g.cookieJar.Changed() {
+		g.saveSession()
+	}
+
+	var body []byte
+	if body, err = io.ReadAll(resp.Body); err != nil {
+		return nil, nil, err
+	}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		var r io.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(body)); err != nil {
+			return nil, nil, err
+		}
+		if body, err = io.ReadAll(r); err != nil {
+			return nil, nil, err
+		}
+	}
+	return resp, body, nil
+}
+
+// This sends a request that needs us to be logged in. If it looks like our
+// session has expired we log in again and retry the request once.
+// If we wanted JSON this also makes sure that's what we got.
+func (g *GeocachingAPI) doAuthenticated(req *http.Request, wantJSON bool) (*http.Response, []byte, error) {
+	// The client adds the jar's cookies to the request itself, so remember the ones
+	// we were given. Otherwise a retry would send the old session along with the new.
+	cookies := append([]string{}, req.Header.Values("Cookie")...)
+	resp, body, err := g.doRead(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = checkResponse(resp); err != nil {
+		return nil, nil, err
+	}
+	if loggedOut(resp, body, wantJSON) {
+		log.Warn("Our gc.com session seems to have expired, logging in again")
+		if err = g.reauth(req.Context()); err != nil {
+			return nil, nil, err
+		}
+		retry := req.Clone(req.Context())
+		retry.Header.Del("Cookie")
+		for _, c := range cookies {
+			retry.Header.Add("Cookie", c)
+		}
+		if resp, body, err = g.doRead(retry); err != nil {
+			return nil, nil, err
+		}
+		if err = checkResponse(resp); err != nil {
+			return nil, nil, err
+		}
+		if loggedOut(resp, body, wantJSON) {
+			return nil, nil, ErrNotAuthenticated
+		}
+	}
+	if wantJSON {
+		if err = checkJSON(resp, body); err != nil {
+			return nil, nil, err
+		}
+	}
+	return resp, body, nil
+}
+
 type GocachePostedCoordinates struct {
 	Latitude  float64 `json:"latitude" fake:"{number:1,180}"`
 	Longitude float64 `json:"longitude" fake:"{number:1,180}"`
@@ -169,11 +392,11 @@ type Geocache struct {
 	Code              string                   `json:"code" fake:"{regex:GC[1-9]{5}}"` // GC12345
 	PremiumOnly       bool                     `json:"premiumOnly" fake:"{bool}"`
 	FavoritePoints    int                      `json:"favoritePoints" fake:"{number:1,1000}"`
-	GeocacheType      int                      `json:"geocacheType" fake:"{number:1,10}"`
-	ContainerType     int                      `json:"containerType" fake:"{number:1,10}"`
+	GeocacheType      GeocacheType             `json:"geocacheType" fake:"{number:1,10}"`
+	ContainerType     ContainerType            `json:"containerType" fake:"{number:1,10}"`
 	Difficulty        float64                  `json:"difficulty" fake:"{number:1,5}"`
 	Terrain           float64                  `json:"terrain" fake:"{number:1,5}"`
-	CacheStatus       int                      `json:"cacheStatus" fake:"{number:1,10}"`
+	CacheStatus       CacheStatus              `json:"cacheStatus" fake:"{number:1,10}"`
 	PostedCoordinates GocachePostedCoordinates `json:"postedCoordinates"`
 	DetailsURL        string                   `json:"detailsUrl" fake:"{url}"`
 	HasGeotour        bool                     `json:"hasGeotour" fake:"{bool}"`
@@ -240,9 +463,9 @@ type GeocacheLogSearchResponse struct {
 
 // This runs the query against the geocaching API and returns a slice of up to `take` geocaches,
 // and the total number of geocaches matching that query
-func (g *GeocachingAPI) searchQuery(st searchTerms, skip, take int) ([]Geocache, int, error) {
+func (g *GeocachingAPI) searchQuery(ctx context.Context, st searchTerms, skip, take int) ([]Geocache, int, error) {
 	var err error
-	req, err := http.NewRequest("GET", g.config.GeocachingAPIURL+"/api/proxy/web/search/v2", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", g.config.GeocachingAPIURL+"/api/proxy/web/search/v2", nil)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -270,37 +493,20 @@ func (g *GeocachingAPI) searchQuery(st searchTerms, skip, take int) ([]Geocache,
 	req.Header.Set("Cookie", "BMItemsPerPage=1000;-H Sec-Fetch-Dest:")
 
 	log.Debug("Request: Search")
-	resp, err := g.client.Do(req)
+	_, body, err := g.doAuthenticated(req, true)
 	if err != nil {
 		return nil, 0, err
 	}
-	defer resp.Body.Close()
-
-	var body []byte
-	if body, err = io.ReadAll(resp.Body); err != nil {
-		return nil, 0, err
-	}
-
-	// Check if the Content-Encoding is gzip, abort if not.
-	if resp.Header.Get("Content-Encoding") == "gzip" {
-		var r io.Reader
-		if r, err = gzip.NewReader(bytes.NewReader(body)); err != nil {
-			return nil, 0, err
-		}
-		if body, err = io.ReadAll(r); err != nil {
-			return nil, 0, err
-		}
-	}
 
 	// Unmarshal body into a GeocacheSearchResponse
 	var searchResponse GeocacheSearchResponse
 	if err = json.Unmarshal(body, &searchResponse); err != nil {
-		return nil, 0, err
+		return nil, 0, fmt.Errorf("%w: %s", ErrUpstream, err)
 	}
 	// Iterate over the results and parse the LastFoundDate
 	for i := 0; i < len(searchResponse.Results); i++ {
 		if searchResponse.Results[i].LastFoundDate != "" {
-			searchResponse.Results[i].LastFoundTime, _ = parseTime(searchResponse.Results[i].LastFoundDate)
+			searchResponse.Results[i].LastFoundTime, _ = parseTime(searchResponse.Results[i].LastFoundDate, st.timeZone())
 		}
 	}
 
@@ -308,19 +514,39 @@ func (g *GeocachingAPI) searchQuery(st searchTerms, skip, take int) ([]Geocache,
 }
 
 // This returns a time.Time parsed from a LastFoundDate or PlacedDate as delivered by the
-// gc.com api.
-func parseTime(date string) (time.Time, error) {
-	// Append my account's time zone to the date so it parses with timezone info
-	// TODO Work out some way of querying a user's time zone use that here instead.
-	tempTime := date + "+10:00"
-	return time.Parse(time.RFC3339, tempTime)
+// gc.com api. They don't say what time zone they're in, so loc should be the search area's.
+func parseTime(date string, loc *time.Location) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02T15:04:05", date, loc)
+}
+
+// The formats a log's Visited and Created dates come in. The logbook uses the
+// account's preferred date format, which is M/D/YYYY by default.
+var logDateLayouts = []string{
+	"1/2/2006",
+	"2006-01-02",
+	"2006-01-02T15:04:05",
 }
 
+// This returns a time.Time parsed from a log's Visited or Created date, in the given time zone.
+func parseLogDate(date string, loc *time.Location) (time.Time, error) {
+	var err error
+	for _, layout := range logDateLayouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, date, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// gc.com shows basic members an upsell page instead of premium geocaches.
+var premiumRegex = regexp.MustCompile(`(?i)premium[ -]member[ -]only`)
+
 // This sets the GUID field on the geocache.
-func (g *GeocachingAPI) GetGUIDForGeocache(geocache *Geocache) error {
+func (g *GeocachingAPI) GetGUIDForGeocache(ctx context.Context, geocache *Geocache) error {
 	url := fmt.Sprintf(g.config.GeocachingAPIURL+"/geocache/%s", geocache.Code)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
@@ -334,12 +560,7 @@ func (g *GeocachingAPI) GetGUIDForGeocache(geocache *Geocache) error {
 	req.Header.Set("Cookie", "BMItemsPerPage=1000;-H Sec-Fetch-Dest:")
 
 	log.Debug("Request: GetGUIDForGeocache")
-	resp, err := g.client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	_, body, err := g.doAuthenticated(req, false)
 	if err != nil {
 		return err
 	}
@@ -347,7 +568,10 @@ func (g *GeocachingAPI) GetGUIDForGeocache(geocache *Geocache) error {
 	rgx := regexp.MustCompile("guid='([a-f0-9-]*)';")
 	matches := rgx.FindStringSubmatch(string(body))
 	if len(matches) < 1 {
-		return fmt.Errorf("could not find guid. This might be a premium geocache")
+		if geocache.PremiumOnly || premiumRegex.Match(body) {
+			return fmt.Errorf("%w: could not find guid for %s", ErrPremiumOnly, geocache.Code)
+		}
+		return fmt.Errorf("%w: could not find guid for %s", ErrUpstream, geocache.Code)
 	}
 	geocache.GUID = matches[1]
 	return nil
@@ -372,26 +596,79 @@ func (g *GeocachingAPI) SanitiseLogText(text string) (result string) {
 // userToken = 'poopppoopppo';
 // Then we can use that
 
-func (g *GeocachingAPI) GetLogs(geocache *Geocache) ([]GeocacheLog, error) {
+// How many logs we ask for in each page of the logbook, and how many pages we'll
+// read before giving up on finding a log we've already seen.
+const (
+	logPageSize = 10
+	maxLogPages = 10
+)
+
+// This returns the logs for a geocache, oldest first. It pages back through the
+// logbook until it reaches a log that seen returns true for, and only returns the
+// logs newer than that one. If seen is nil only the most recent page is read. If
+// none of the logs have been seen, E.G. because the one we had was deleted, we
+// can't tell which are new, so only the newest is returned rather than the
+// cache's whole history.
+func (g *GeocachingAPI) GetLogs(ctx context.Context, geocache *Geocache, seen func(*GeocacheLog) bool) ([]GeocacheLog, error) {
 	var err error
 
-	if !g.config.UnThrottle {
-		// Wait a random number of seconds between 3 and 8
-		time.Sleep(time.Duration(rand.Intn(5)+3) * time.Second)
+	// Wait a random number of seconds between 3 and 8
+	if err = g.client.Jitter(ctx, 3*time.Second, 8*time.Second); err != nil {
+		return nil, err
 	}
 
 	// Get the GUID for the geocache, if required
 	if geocache.GUID == "" {
-		err = g.GetGUIDForGeocache(geocache)
+		err = g.GetGUIDForGeocache(ctx, geocache)
 		if err != nil {
 			return nil, err
 		}
 	}
+	userToken, err := g.getLogbookToken(ctx, geocache)
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []GeocacheLog
+	found := seen == nil
+	for idx := 1; idx <= maxLogPages; idx++ {
+		var page GeocacheLogSearchResponse
+		if page, err = g.getLogbookPage(ctx, userToken, idx); err != nil {
+			return nil, err
+		}
+		done := seen == nil || len(page.Data) == 0 || idx >= page.PageInfo.TotalPages
+		for i := range page.Data {
+			if seen != nil && seen(&page.Data[i]) {
+				found = true
+				done = true
+				break
+			}
+			page.Data[i].LogText = g.SanitiseLogText(page.Data[i].LogText)
+			logs = append(logs, page.Data[i])
+		}
+		if done {
+			break
+		}
+	}
+	if !found && len(logs) > 1 {
+		log.Warn("Couldn't find the last log we'd seen on ", geocache.Code, ", only taking the newest")
+		logs = logs[:1]
+	}
+
+	// The logbook is newest first.
+	for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
+		logs[i], logs[j] = logs[j], logs[i]
+	}
+	return logs, nil
+}
+
+// This fetches the token needed to read a geocache's logbook.
+func (g *GeocachingAPI) getLogbookToken(ctx context.Context, geocache *Geocache) (string, error) {
 	url := fmt.Sprintf(g.config.GeocachingAPIURL+"/seek/geocache_logs.aspx?guid=%s", geocache.GUID)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:109.0) Gecko/20100101 Firefox/110.0")
@@ -404,95 +681,86 @@ func (g *GeocachingAPI) GetLogs(geocache *Geocache) ([]GeocacheLog, error) {
 	req.Header.Set("Cookie", "BMItemsPerPage=1000;-H Sec-Fetch-Dest:")
 
 	log.Debug("Request: GetLogs userToken")
-	resp, err := g.client.Do(req)
+	_, body, err := g.doAuthenticated(req, false)
 	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	rgx := regexp.MustCompile("userToken = '([A-Z0-9]*)';")
 	matches := rgx.FindStringSubmatch(string(body))
 	if len(matches) < 1 {
-		return nil, fmt.Errorf("could not find the userToken required to request the logs")
+		if geocache.PremiumOnly || premiumRegex.Match(body) {
+			return "", fmt.Errorf("%w: could not find the userToken for %s", ErrPremiumOnly, geocache.Code)
+		}
+		return "", fmt.Errorf("%w: could not find the userToken required to request the logs", ErrUpstream)
 	}
-	userToken := matches[1]
+	return matches[1], nil
+}
 
-	// Now we have the userToken, we can request the logs
-	req, err = http.NewRequest("GET", g.config.GeocachingAPIURL+"/seek/geocache.logbook", nil)
+// This fetches one page of a geocache's logbook. Pages are numbered from 1.
+func (g *GeocachingAPI) getLogbookPage(ctx context.Context, userToken string, idx int) (GeocacheLogSearchResponse, error) {
+	var logresponse GeocacheLogSearchResponse
+	req, err := http.NewRequestWithContext(ctx, "GET", g.config.GeocachingAPIURL+"/seek/geocache.logbook", nil)
 	if err != nil {
-		return nil, err
+		return logresponse, err
 	}
 	query := req.URL.Query()
 	query.Add("tkn", userToken)
-	query.Add("idx", "1")
-	query.Add("num", "10")
+	query.Add("idx", fmt.Sprint(idx))
+	query.Add("num", fmt.Sprint(logPageSize))
 	query.Add("sp", "false")
 	query.Add("sf", "false")
 	query.Add("decrypt", "false")
 	req.URL.RawQuery = query.Encode()
 
-	log.Debug("Request: GetLogs Logs")
-	logResp, err := g.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer logResp.Body.Close()
-	logBody, err := io.ReadAll(logResp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	// Unmarshal logBody into a struct
-	var logresponse GeocacheLogSearchResponse
-	err = json.Unmarshal(logBody, &logresponse)
+	log.Debug("Request: GetLogs Logs page ", idx)
+	_, logBody, err := g.doAuthenticated(req, true)
 	if err != nil {
-		return nil, err
+		return logresponse, err
 	}
 
-	// Go through and sanitise all the log text.
-	for i := 0; i < len(logresponse.Data); i++ {
-		logresponse.Data[i].LogText = g.SanitiseLogText(logresponse.Data[i].LogText)
+	if err = json.Unmarshal(logBody, &logresponse); err != nil {
+		return logresponse, fmt.Errorf("%w: %s", ErrUpstream, err)
 	}
-
-	return logresponse.Data, nil
-
+	return logresponse, nil
 }
 
-// This finds all geocaches
-func (g *GeocachingAPI) Search(st searchTerms) ([]Geocache, error) {
-	var err error
-	var results []Geocache
-	log.Println("Running a search")
-
-	// Run the first query to get the total number of results
-	var total int
-	if results, total, err = g.searchQuery(st, 0, 500); err != nil {
-		return nil, err
-	}
-
-	// This is to confirm that we don't spin endlessly spamming search
-	// requests if something goes awry.
-	var sanityCheck int
+// How many results we ask for in each page of a search.
+const searchPageSize = 500
 
-	// Run the rest of the queries to get the rest of the results
-	for i := 500; i < total; i += 500 {
-		sanityCheck++
-		if sanityCheck > 10 {
-			return nil, fmt.Errorf("sanity check failed")
-		}
-		if !g.config.UnThrottle {
-			// Wait a random number of seconds between 2 and 5
-			time.Sleep(time.Duration(rand.Intn(3)+2) * time.Second)
+// This finds all geocaches in the search area. Areas with too many caches for
+// one search are split into tiles, see tiles.go.
+func (g *GeocachingAPI) Search(ctx context.Context, st searchTerms) ([]Geocache, error) {
+	log.Println("Running a search")
+	var found, results []Geocache
+	var leaves []searchTerms
+	tiles := g.tiles.get(st)
+	for i, tile := range tiles {
+		if i > 0 {
+			if err := g.client.Jitter(ctx, 2*time.Second, 5*time.Second); err != nil {
+				return nil, err
+			}
 		}
-		var nextResults []Geocache
-		if nextResults, _, err = g.searchQuery(st, i, 500); err != nil {
+		caches, tileLeaves, err := g.searchTile(ctx, tile)
+		if err != nil {
 			return nil, err
 		}
-		results = append(results, nextResults...)
+		found = append(found, caches...)
+		leaves = append(leaves, tileLeaves...)
+	}
+	g.tiles.set(st, leaves)
+	results = found
+	if len(leaves) > 1 {
+		// The tiles overlap each other, and the edge of the area.
+		results = nil
+		seen := make(map[string]bool)
+		for _, gc := range found {
+			if seen[gc.Code] || !st.contains(&gc) {
+				continue
+			}
+			seen[gc.Code] = true
+			results = append(results, gc)
+		}
 	}
 
 	if !st.IgnorePremium {
@@ -509,3 +777,49 @@ func (g *GeocachingAPI) Search(st searchTerms) ([]Geocache, error) {
 
 	return nonPremiumGeocaches, nil
 }
+
+// This finds all geocaches in a single tile. If there are too many it splits
+// the tile into four and searches each of those instead. It returns the caches
+// it found and the tiles it ended up searching.
+func (g *GeocachingAPI) searchTile(ctx context.Context, st searchTerms) ([]Geocache, []searchTerms, error) {
+	// Run the first query to get the total number of results
+	results, total, err := g.searchQuery(ctx, st, 0, searchPageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if total > g.searchLimit && st.RadiusMeters > minTileRadiusMeters {
+		log.Printf("%d geocaches within %dm of %f,%f, splitting the search", total, st.RadiusMeters, st.Latitude, st.Longitude)
+		var leaves []searchTerms
+		results = nil
+		for _, tile := range splitTile(st) {
+			if err = g.client.Jitter(ctx, 2*time.Second, 5*time.Second); err != nil {
+				return nil, nil, err
+			}
+			caches, tileLeaves, err := g.searchTile(ctx, tile)
+			if err != nil {
+				return nil, nil, err
+			}
+			results = append(results, caches...)
+			leaves = append(leaves, tileLeaves...)
+		}
+		return results, leaves, nil
+	}
+	if total > g.searchLimit {
+		log.Warnf("%d geocaches within %dm of %f,%f, only fetching the first %d", total, st.RadiusMeters, st.Latitude, st.Longitude, g.searchLimit)
+		total = g.searchLimit
+	}
+
+	// Run the rest of the queries to get the rest of the results
+	for i := searchPageSize; i < total; i += searchPageSize {
+		// Wait a random number of seconds between 2 and 5
+		if err = g.client.Jitter(ctx, 2*time.Second, 5*time.Second); err != nil {
+			return nil, nil, err
+		}
+		var nextResults []Geocache
+		if nextResults, _, err = g.searchQuery(ctx, st, i, searchPageSize); err != nil {
+			return nil, nil, err
+		}
+		results = append(results, nextResults...)
+	}
+	return results, []searchTerms{st}, nil
+}
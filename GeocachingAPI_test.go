@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/brianvoe/gofakeit/v6"
 	"github.com/google/uuid"
@@ -59,7 +63,7 @@ func TestAuthSuccess(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := gc.Auth("client_id", "client_secret"); err != nil {
+	if err := gc.Auth(context.Background(), "client_id", "client_secret"); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -96,7 +100,7 @@ func TestAuthFail1(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := gc.Auth("client_id", "client_secret"); err == nil {
+	if err := gc.Auth(context.Background(), "client_id", "client_secret"); err == nil {
 		t.Fatal("Should've got an error, but didn't")
 	} else {
 		if want, got := "Anti-Forgery Token is invalid", err.Error(); want != got {
@@ -137,7 +141,7 @@ func TestAuthFail2(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := gc.Auth("client_id", "client_secret"); err == nil {
+	if err := gc.Auth(context.Background(), "client_id", "client_secret"); err == nil {
 		t.Fatal("Should've got an error, but didn't")
 	} else {
 		if want, got := "login failed", err.Error(); want != got {
@@ -263,7 +267,7 @@ func TestSearchQuery(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Test doing a search for all caches.
-	if caches, err := gc.Search(st); err != nil {
+	if caches, err := gc.Search(context.Background(), st); err != nil {
 		t.Fatal(err)
 	} else {
 		if want, got := totalCaches, len(caches); want != got {
@@ -273,7 +277,7 @@ func TestSearchQuery(t *testing.T) {
 	// Test ignoring premium caches.
 	st.IgnorePremium = true
 	var caches []Geocache
-	if caches, err = gc.Search(st); err != nil {
+	if caches, err = gc.Search(context.Background(), st); err != nil {
 		t.Fatal(err)
 	}
 	// Check we got fewer than all caches.
@@ -282,7 +286,7 @@ func TestSearchQuery(t *testing.T) {
 	}
 	// Check the GUID gets updated when we call GetGUIDForGeocache.
 	oldGUID := caches[0].GUID
-	if err = gc.GetGUIDForGeocache(&caches[0]); err != nil {
+	if err = gc.GetGUIDForGeocache(context.Background(), &caches[0]); err != nil {
 		t.Fatal(err)
 	}
 	if want, got := oldGUID, caches[0].GUID; want == got {
@@ -291,7 +295,7 @@ func TestSearchQuery(t *testing.T) {
 	fakeLogs[0].CacheID = caches[0].ID
 	var logs []GeocacheLog
 	// Test getting the log for this geocache.
-	if logs, err = gc.GetLogs(&caches[0]); err != nil {
+	if logs, err = gc.GetLogs(context.Background(), &caches[0], nil); err != nil {
 		t.Fatal(err)
 	}
 	if want, got := 1, len(logs); want != got {
@@ -301,3 +305,453 @@ func TestSearchQuery(t *testing.T) {
 		t.Errorf("Expected username to be '%s', got: %s", want, got)
 	}
 }
+
+func TestGetLogsPaging(t *testing.T) {
+	// The logbook is newest first, so log 25 is on the first page.
+	totalLogs := 25
+	var pagesRequested int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/seek/geocache_logs.aspx" {
+			w.Write([]byte(`userToken = 'ABC123CBA321';`))
+		} else if r.URL.Path == "/seek/geocache.logbook" {
+			pagesRequested++
+			idx, _ := strconv.Atoi(r.URL.Query().Get("idx"))
+			num, _ := strconv.Atoi(r.URL.Query().Get("num"))
+			var logSearchResponse GeocacheLogSearchResponse
+			for id := totalLogs - (idx-1)*num; id > totalLogs-idx*num && id > 0; id-- {
+				logSearchResponse.Data = append(logSearchResponse.Data, GeocacheLog{LogID: id, UserName: fmt.Sprint("finder", id)})
+			}
+			logSearchResponse.PageInfo.Idx = idx
+			logSearchResponse.PageInfo.Size = num
+			logSearchResponse.PageInfo.TotalRows = totalLogs
+			logSearchResponse.PageInfo.TotalPages = (totalLogs + num - 1) / num
+			json.NewEncoder(w).Encode(logSearchResponse)
+		} else {
+			t.Errorf("Unexpected request to: %s\n", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	gc, err := NewGeocachingAPI(APIConfig{GeocachingAPIURL: server.URL, UnThrottle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := Geocache{Code: "GC1234", GUID: uuid.NewString()}
+
+	// We last saw log 7, which is on the second page.
+	logs, err := gc.GetLogs(context.Background(), &cache, func(l *GeocacheLog) bool { return l.LogID <= 7 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, pagesRequested; want != got {
+		t.Errorf("Expected %d pages to be requested, got %d", want, got)
+	}
+	if want, got := 18, len(logs); want != got {
+		t.Fatalf("Expected %d logs, got %d", want, got)
+	}
+	// They should be oldest first.
+	if want, got := 8, logs[0].LogID; want != got {
+		t.Errorf("Expected the first log to be %d, got %d", want, got)
+	}
+	if want, got := 25, logs[len(logs)-1].LogID; want != got {
+		t.Errorf("Expected the last log to be %d, got %d", want, got)
+	}
+
+	// Without knowing what we've seen, only the first page is read.
+	pagesRequested = 0
+	if logs, err = gc.GetLogs(context.Background(), &cache, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, pagesRequested; want != got {
+		t.Errorf("Expected %d pages to be requested, got %d", want, got)
+	}
+	if want, got := logPageSize, len(logs); want != got {
+		t.Errorf("Expected %d logs, got %d", want, got)
+	}
+
+	// If we've seen none of them we read the whole logbook, but can't tell which
+	// are new, so we only take the newest rather than posting its whole history.
+	pagesRequested = 0
+	if logs, err = gc.GetLogs(context.Background(), &cache, func(l *GeocacheLog) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, pagesRequested; want != got {
+		t.Errorf("Expected %d pages to be requested, got %d", want, got)
+	}
+	if want, got := 1, len(logs); want != got {
+		t.Fatalf("Expected %d logs, got %d", want, got)
+	}
+	if want, got := totalLogs, logs[0].LogID; want != got {
+		t.Errorf("Expected the log to be %d, got %d", want, got)
+	}
+}
+
+func TestReauth(t *testing.T) {
+	loggedIn := false
+	loginWorks := true
+	var logins int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/account/signin":
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`<html>name="__RequestVerificationToken" type="hidden" value="plooybloots" /></html>`))
+				return
+			}
+			logins++
+			if !loginWorks {
+				w.Write([]byte(`"isLoggedIn": false,`))
+				return
+			}
+			loggedIn = true
+			w.Write([]byte(`"isLoggedIn": true,`))
+		case "/api/proxy/web/search/v2":
+			if !loggedIn {
+				// This is what gc.com does when your session has expired.
+				http.Redirect(w, r, "/account/signin?returnUrl=%2fplay", http.StatusFound)
+				return
+			}
+			json.NewEncoder(w).Encode(GeocacheSearchResponse{Total: 1, Results: []Geocache{{Code: "GC1234"}}})
+		case "/seek/geocache.logbook":
+			if !loggedIn {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(GeocacheLogSearchResponse{})
+		default:
+			t.Errorf("Unexpected request to: %s\n", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	gc, err := NewGeocachingAPI(APIConfig{GeocachingAPIURL: server.URL, UnThrottle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.Auth(context.Background(), "client_id", "client_secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Our session expires, so we should log in again and retry the search.
+	loggedIn = false
+	caches, err := gc.Search(context.Background(), searchTerms{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(caches); want != got {
+		t.Errorf("Expected %d caches, got %d", want, got)
+	}
+	if want, got := 2, logins; want != got {
+		t.Errorf("Expected %d logins, got %d", want, got)
+	}
+
+	// If we can't log in again we give up, and don't try again straight away.
+	loggedIn = false
+	loginWorks = false
+	if _, err := gc.getLogbookPage(context.Background(), "ABC123", 1); !errors.Is(err, ErrNotAuthenticated) {
+		t.Errorf("Expected a not logged in error, got %v", err)
+	}
+	if _, err := gc.Search(context.Background(), searchTerms{}); !errors.Is(err, ErrNotAuthenticated) {
+		t.Errorf("Expected a not logged in error, got %v", err)
+	}
+	if want, got := 3, logins; want != got {
+		t.Errorf("Expected %d logins, got %d", want, got)
+	}
+}
+
+func TestReauthCookies(t *testing.T) {
+	session := "one"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/account/signin":
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`<html>name="__RequestVerificationToken" type="hidden" value="plooybloots" /></html>`))
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "gspkauth", Value: session, Path: "/"})
+			w.Write([]byte(`"isLoggedIn": true,`))
+		case "/api/proxy/web/search/v2":
+			var auth []string
+			for _, c := range r.Cookies() {
+				if c.Name == "gspkauth" {
+					auth = append(auth, c.Value)
+				}
+			}
+			if len(auth) != 1 || auth[0] != session {
+				http.Redirect(w, r, "/account/signin?returnUrl=%2fplay", http.StatusFound)
+				return
+			}
+			if c, err := r.Cookie("BMItemsPerPage"); err != nil || c.Value != "1000" {
+				t.Errorf("Expected the BMItemsPerPage cookie, got %q", r.Header.Get("Cookie"))
+			}
+			json.NewEncoder(w).Encode(GeocacheSearchResponse{Total: 1, Results: []Geocache{{Code: "GC1234"}}})
+		}
+	}))
+	defer server.Close()
+	gc, err := NewGeocachingAPI(APIConfig{GeocachingAPIURL: server.URL, UnThrottle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.Auth(context.Background(), "client_id", "client_secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Our session expires, so the retry should only carry the new session's cookie.
+	session = "two"
+	caches, err := gc.Search(context.Background(), searchTerms{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(caches); want != got {
+		t.Errorf("Expected %d caches, got %d", want, got)
+	}
+}
+
+func TestSessionPersistence(t *testing.T) {
+	session := "firstsession"
+	var logins, checks int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/account/signin":
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`name="__RequestVerificationToken" type="hidden" value="plooybloots" />`))
+				return
+			}
+			logins++
+			http.SetCookie(w, &http.Cookie{Name: "gspkauth", Value: session, Path: "/", Expires: time.Now().Add(time.Hour)})
+			w.Write([]byte(`"isLoggedIn": true,`))
+		case sessionCheckPath:
+			checks++
+			if c, err := r.Cookie("gspkauth"); err != nil || c.Value != session {
+				http.Redirect(w, r, "/account/signin?returnUrl=%2faccount%2fsettings%2fprofile", http.StatusFound)
+				return
+			}
+			w.Write([]byte(`<html>Your profile</html>`))
+		case "/api/proxy/web/search/v2":
+			// gc.com sometimes hands out a new session part way through.
+			session = "refreshedsession"
+			http.SetCookie(w, &http.Cookie{Name: "gspkauth", Value: session, Path: "/", Expires: time.Now().Add(time.Hour)})
+			json.NewEncoder(w).Encode(GeocacheSearchResponse{})
+		default:
+			t.Errorf("Unexpected request to: %s\n", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	c := APIConfig{
+		GeocachingAPIURL: server.URL,
+		UnThrottle:       true,
+		CookieFile:       t.TempDir() + "/cookies",
+	}
+	auth := func() *GeocachingAPI {
+		t.Helper()
+		gc, err := NewGeocachingAPI(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := gc.Auth(context.Background(), "client_id", "client_secret"); err != nil {
+			t.Fatal(err)
+		}
+		return gc
+	}
+
+	// With nothing saved we have to log in, and the session is saved.
+	auth()
+	if want, got := 1, logins; want != got {
+		t.Errorf("Expected %d logins, got %d", want, got)
+	}
+	if info, err := os.Stat(c.CookieFile); err != nil {
+		t.Fatal(err)
+	} else if want, got := os.FileMode(0600), info.Mode().Perm(); want != got {
+		t.Errorf("Expected the cookie file to have permissions %s, got %s", want, got)
+	}
+
+	// After a restart the saved session is checked and reused.
+	auth()
+	if want, got := 1, logins; want != got {
+		t.Errorf("Expected %d logins, got %d", want, got)
+	}
+	if want, got := 1, checks; want != got {
+		t.Errorf("Expected %d session checks, got %d", want, got)
+	}
+
+	// If the saved session has expired we log in again.
+	session = "secondsession"
+	gc := auth()
+	if want, got := 2, logins; want != got {
+		t.Errorf("Expected %d logins, got %d", want, got)
+	}
+
+	// If gc.com refreshes our session, the new one is saved and reused after a restart.
+	if _, err := gc.Search(context.Background(), searchTerms{}); err != nil {
+		t.Fatal(err)
+	}
+	auth()
+	if want, got := 2, logins; want != got {
+		t.Errorf("Expected %d logins, got %d", want, got)
+	}
+
+	// A cookie file anyone can read isn't trusted.
+	if err := os.Chmod(c.CookieFile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	auth()
+	if want, got := 3, logins; want != got {
+		t.Errorf("Expected %d logins, got %d", want, got)
+	}
+}
+
+func TestResponseErrors(t *testing.T) {
+	var status int
+	var contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "120")
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	gc, err := NewGeocachingAPI(APIConfig{GeocachingAPIURL: server.URL, UnThrottle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		want        error
+	}{
+		{"rate limited", http.StatusTooManyRequests, "text/html", "<html>Slow down</html>", ErrRateLimited},
+		{"server error", http.StatusInternalServerError, "text/html", "<html>Oops</html>", ErrUpstream},
+		{"unavailable", http.StatusServiceUnavailable, "", "", ErrUpstream},
+		{"not found", http.StatusNotFound, "application/json", "{}", ErrUpstream},
+		{"not JSON", http.StatusOK, "text/plain", "Bloopa doopa", ErrUpstream},
+		{"bad JSON", http.StatusOK, "application/json", `{"results": 7}`, ErrUpstream},
+	} {
+		status, contentType, body = test.status, test.contentType, test.body
+		if _, err := gc.Search(context.Background(), searchTerms{}); !errors.Is(err, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, err)
+		}
+	}
+
+	// Basic members get an upsell page instead of premium caches.
+	status, contentType, body = http.StatusOK, "text/html", "<html>This is a Premium Member Only cache.</html>"
+	if err := gc.GetGUIDForGeocache(context.Background(), &Geocache{Code: "GC1234"}); !errors.Is(err, ErrPremiumOnly) {
+		t.Errorf("Expected %v, got %v", ErrPremiumOnly, err)
+	}
+	body = "<html>Something else entirely</html>"
+	if err := gc.GetGUIDForGeocache(context.Background(), &Geocache{Code: "GC1234"}); !errors.Is(err, ErrUpstream) {
+		t.Errorf("Expected %v, got %v", ErrUpstream, err)
+	}
+}
+
+func TestSearchCancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hang until the test is over, like a very slow gc.com.
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	gc, err := NewGeocachingAPI(APIConfig{GeocachingAPIURL: server.URL, UnThrottle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := gc.Search(ctx, searchTerms{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the search to be cancelled promptly, took %s", elapsed)
+	}
+}
+
+func TestSearchTiling(t *testing.T) {
+	area := searchTerms{Latitude: -27.5, Longitude: 153.0, RadiusMeters: 2000}
+	// A grid of caches every 200m or so, some of them outside the area.
+	var caches []Geocache
+	for y := -12; y <= 12; y++ {
+		for x := -12; x <= 12; x++ {
+			caches = append(caches, Geocache{
+				Code: fmt.Sprintf("GC%d_%d", x, y),
+				PostedCoordinates: GocachePostedCoordinates{
+					Latitude:  -27.5 + float64(y)*0.0018,
+					Longitude: 153.0 + float64(x)*0.002,
+				},
+			})
+		}
+	}
+	var searches int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		searches++
+		var tile searchTerms
+		var lat, lon float32
+		fmt.Sscanf(r.URL.Query().Get("origin"), "%f,%f", &lat, &lon)
+		tile.Latitude, tile.Longitude = lat, lon
+		tile.RadiusMeters, _ = strconv.Atoi(r.URL.Query().Get("rad"))
+		var searchResponse GeocacheSearchResponse
+		for i := range caches {
+			if tile.contains(&caches[i]) {
+				searchResponse.Results = append(searchResponse.Results, caches[i])
+			}
+		}
+		searchResponse.Total = len(searchResponse.Results)
+		json.NewEncoder(w).Encode(searchResponse)
+	}))
+	defer server.Close()
+	c := APIConfig{GeocachingAPIURL: server.URL, UnThrottle: true, TileFile: t.TempDir() + "/tiles"}
+	search := func() []Geocache {
+		t.Helper()
+		gc, err := NewGeocachingAPI(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gc.searchLimit = 40
+		results, err := gc.Search(context.Background(), area)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+
+	var want int
+	for i := range caches {
+		if area.contains(&caches[i]) {
+			want++
+		}
+	}
+	results := search()
+	if want, got := want, len(results); want != got {
+		t.Errorf("Expected %d caches, got %d", want, got)
+	}
+	codes := make(map[string]bool)
+	for i := range results {
+		if codes[results[i].Code] {
+			t.Errorf("Expected %s to only be returned once", results[i].Code)
+		}
+		codes[results[i].Code] = true
+		if !area.contains(&results[i]) {
+			t.Errorf("Expected %s to be inside the search area", results[i].Code)
+		}
+	}
+	if searches <= 5 {
+		t.Fatalf("Expected the search to be split up, only made %d searches", searches)
+	}
+
+	// Next time it goes straight to the tiles, without searching the whole area first.
+	tiles := len(newTileCache(c.TileFile).get(area))
+	searches = 0
+	if want, got := want, len(search()); want != got {
+		t.Errorf("Expected %d caches, got %d", want, got)
+	}
+	if want, got := tiles, searches; want != got {
+		t.Errorf("Expected %d searches, got %d", want, got)
+	}
+}
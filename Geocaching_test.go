@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
 type mockGeocachingApi struct {
-	caches []Geocache
-	logs   []GeocacheLog
+	caches  []Geocache
+	logs    []GeocacheLog
+	logsErr error               // If set, GetLogs returns this.
+	areas   map[string][]string // If set, the codes of the caches Search finds in each area.
 }
 
 // Populate some dummy data into the struct
@@ -147,9 +154,9 @@ func (m *mockGeocachingApi) populate() {
 			Images: []any{},
 		},
 		{
-			LogID:               2150129950,
+			LogID:               2150129951,
 			CacheID:             789123,
-			LogGUID:             "fc59d67c-ccda-45a7-ad5c-f9a09f040d60",
+			LogGUID:             "fc59d67c-ccda-45a7-ad5c-f9a09f040d61",
 			Latitude:            37.7749,
 			Longitude:           -122.4194,
 			LatLonString:        "37.7749,-122.4194",
@@ -181,25 +188,75 @@ func (m *mockGeocachingApi) populate() {
 	}
 }
 
-// Advance the last found date on the stored cache
+// Add a copy of an existing cache under a new code, as though it had just been published
+func (m *mockGeocachingApi) addCache(index int, code string) {
+	gc := m.caches[index]
+	gc.Code = code
+	gc.DetailsURL = "/geocache/" + code
+	m.caches = append(m.caches, gc)
+}
+
+// Advance the last found date on the stored cache, as though the last person to
+// log it had just logged it again
 func (m *mockGeocachingApi) advanceLastFoundDate(index int) {
 	m.caches[index].LastFoundTime = m.caches[index].LastFoundTime.Add(time.Hour * 24)
+	m.addLog(index, m.newestLog(index).UserName)
+}
+
+// Add a new log to a cache's logbook, copied from its newest log
+func (m *mockGeocachingApi) addLog(index int, userName string) {
+	l := *m.newestLog(index)
+	l.LogID = len(m.logs) + 1
+	l.LogGUID = uuid.NewString()
+	l.UserName = userName
+	l.Visited = time.Now().UTC().Format("1/2/2006")
+	l.Created = l.Visited
+	m.logs = append(m.logs, l)
+}
+
+// Return the newest log on a cache
+func (m *mockGeocachingApi) newestLog(index int) *GeocacheLog {
+	for i := len(m.logs) - 1; i >= 0; i-- {
+		if m.logs[i].CacheID == m.caches[index].ID {
+			return &m.logs[i]
+		}
+	}
+	return nil
 }
 
-func (m *mockGeocachingApi) Auth(clientID, clientSecret string) error {
+func (m *mockGeocachingApi) Auth(ctx context.Context, clientID, clientSecret string) error {
 	return nil
 }
 
-func (m *mockGeocachingApi) Search(st searchTerms) ([]Geocache, error) {
-	return m.caches, nil
+func (m *mockGeocachingApi) Search(ctx context.Context, st searchTerms) ([]Geocache, error) {
+	if m.areas == nil {
+		return m.caches, nil
+	}
+	var caches []Geocache
+	for _, code := range m.areas[st.AreaName] {
+		for _, gc := range m.caches {
+			if gc.Code == code {
+				caches = append(caches, gc)
+			}
+		}
+	}
+	return caches, nil
 }
 
-func (m *mockGeocachingApi) GetLogs(geocache *Geocache) ([]GeocacheLog, error) {
+func (m *mockGeocachingApi) GetLogs(ctx context.Context, geocache *Geocache, seen func(*GeocacheLog) bool) ([]GeocacheLog, error) {
+	if m.logsErr != nil {
+		return nil, m.logsErr
+	}
 	var logs []GeocacheLog
-	for _, log := range m.logs {
-		if log.CacheID == geocache.ID {
-			logs = append(logs, log)
+	for i := len(m.logs) - 1; i >= 0; i-- {
+		log := m.logs[i]
+		if log.CacheID != geocache.ID {
+			continue
+		}
+		if seen != nil && seen(&log) {
+			break
 		}
+		logs = append([]GeocacheLog{log}, logs...)
 	}
 	return logs, nil
 }
@@ -216,32 +273,49 @@ func TestUpdate(t *testing.T) {
 	var g *Geocaching
 	api := &mockGeocachingApi{}
 	api.populate()
-	if g, err = NewGeocaching(conf, api); err != nil {
+	if g, err = NewGeocaching(context.Background(), conf, api); err != nil {
 		log.Fatal(err)
 		os.Exit(1)
 	}
 	defer g.Close()
 	var logs []postDetails
-	logs, err = g.Update()
+	logs, err = g.Update(context.Background())
 	if err != nil {
 		t.Errorf("Expected no error, got %s", err)
 	}
-	if want, got := 2, len(logs); want != got {
+	// The first run against an empty database shouldn't announce anything.
+	if want, got := 0, len(logs); want != got {
 		t.Errorf("Expected %d logs, got %d", want, got)
 	}
 
+	// Publish a new cache
+	api.addCache(0, "GC9999")
+	logs, err = g.Update(context.Background())
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	if want, got := 1, len(logs); want != got {
+		t.Fatalf("Expected %d logs, got %d", want, got)
+	}
+
 	// Check that this cache showed up as a new one
 	if !logs[0].NewCache {
 		t.Errorf("Expected this to be a new cache")
 	}
-	// Check that it has the owner's details, not the owner's
+	// Check that it has the owner's details, not the finder's
 	if want, got := "JimblyBimbly", logs[0].UserName; want != got {
 		t.Errorf("Expected the owner to be %s, got %s", want, got)
 	}
+	if want, got := "D3.5/T2.5", logs[0].toString(500); !strings.Contains(got, want) {
+		t.Errorf("Expected the post to contain %q, got %q", want, got)
+	}
+	if want, got := "1 January 2020", logs[0].toString(500); !strings.Contains(got, want) {
+		t.Errorf("Expected the post to contain %q, got %q", want, got)
+	}
 
 	// Advance the last found date on the mock cache
 	api.advanceLastFoundDate(0)
-	logs, err = g.Update()
+	logs, err = g.Update(context.Background())
 	if err != nil {
 		t.Errorf("Expected no error, got %s", err)
 	}
@@ -257,17 +331,17 @@ func TestUpdate(t *testing.T) {
 		t.Errorf("Expected the finder to be %s, got %s", want, got)
 	}
 	// Check the very long message was truncated properly.
-	if want, got := 500, len(logs[0].toString()); want != got {
+	if want, got := 500, mastodonLength(logs[0].toString(500)); want != got {
 		t.Errorf("Expected the log to be %d characters, got %d", want, got)
 	}
 	// Check the truncated string ends with "" #geocaching"
-	if want, got := `" #geocaching`, logs[0].toString()[len(logs[0].toString())-13:]; want != got {
+	if want, got := `" #geocaching`, logs[0].toString(500)[len(logs[0].toString(500))-13:]; want != got {
 		t.Errorf("Expected the log to end with %q, got %q", want, got)
 	}
 
 	// TODO Check that we get the "That's their second find for the day!" thing.
 	api.advanceLastFoundDate(0)
-	logs, err = g.Update()
+	logs, err = g.Update(context.Background())
 	if err != nil {
 		t.Errorf("Expected no error, got %s", err)
 	}
@@ -282,7 +356,7 @@ func TestUpdate(t *testing.T) {
 		t.Errorf("Expected the finder to have found %d caches, got %d", want, got)
 	}
 
-	logs, err = g.Update()
+	logs, err = g.Update(context.Background())
 	if err != nil {
 		t.Errorf("Expected no error, got %s", err)
 	}
@@ -291,7 +365,7 @@ func TestUpdate(t *testing.T) {
 	}
 
 	api.advanceLastFoundDate(1)
-	logs, err = g.Update()
+	logs, err = g.Update(context.Background())
 	if err != nil {
 		t.Errorf("Expected no error, got %s", err)
 	}
@@ -304,7 +378,7 @@ func TestUpdate(t *testing.T) {
 	}
 	api.advanceLastFoundDate(0)
 	api.advanceLastFoundDate(1)
-	logs, err = g.Update()
+	logs, err = g.Update(context.Background())
 	if err != nil {
 		t.Errorf("Expected no error, got %s", err)
 	}
@@ -312,3 +386,566 @@ func TestUpdate(t *testing.T) {
 		t.Errorf("Expected %d logs, got %d", want, got)
 	}
 }
+
+func TestUpdateLogTypes(t *testing.T) {
+	var err error
+	tempdir := t.TempDir()
+	conf := configStore{
+		SearchTerms: searchTerms{
+			AreaName: "Blerpville",
+		},
+		DBFilename: tempdir + "/test.sqlite3",
+		LogTypes: map[string]string{
+			kindNeedsMaintenance: policyDigest,
+		},
+	}
+	var g *Geocaching
+	api := &mockGeocachingApi{}
+	api.populate()
+	if g, err = NewGeocaching(context.Background(), conf, api); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A DNF should be posted as a DNF, not a find.
+	api.advanceLastFoundDate(1)
+	api.newestLog(1).LogTypeID = 3
+	api.newestLog(1).LogType = "Didn't find it"
+	posts, err := g.Update(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(posts); want != got {
+		t.Fatalf("Expected %d posts, got %d", want, got)
+	}
+	if want, got := kindDNF, posts[0].Kind; want != got {
+		t.Errorf("Expected a %s post, got %s", want, got)
+	}
+	if want, got := "couldn't find", posts[0].toString(500); !strings.Contains(got, want) {
+		t.Errorf("Expected the post to contain %q, got %q", want, got)
+	}
+	// The DNF is recorded, but doesn't count as a find.
+	var find CacheFind
+	g.db.db.Last(&find)
+	if want, got := "Didn't find it", find.FindType; want != got {
+		t.Errorf("Expected the find type to be %q, got %q", want, got)
+	}
+	if want, got := 0, g.db.FindsSinceMidnight("Beepo", time.UTC); want != got {
+		t.Errorf("Expected %d finds today, got %d", want, got)
+	}
+
+	// Notes are ignored by default.
+	api.advanceLastFoundDate(1)
+	api.newestLog(1).LogTypeID = 4
+	api.newestLog(1).LogType = "Write note"
+	if posts, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(posts); want != got {
+		t.Errorf("Expected %d posts, got %d", want, got)
+	}
+
+	// Needs maintenance logs are saved up for the digest.
+	api.advanceLastFoundDate(1)
+	api.newestLog(1).LogTypeID = 45
+	api.newestLog(1).LogType = "Needs Maintenance"
+	if posts, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(posts); want != got {
+		t.Errorf("Expected %d posts, got %d", want, got)
+	}
+	if digests := g.buildDigests(context.Background(), &g.areas[0], time.Now().UTC()); len(digests) != 0 {
+		t.Errorf("Didn't expect a digest yet")
+	}
+	digests := g.buildDigests(context.Background(), &g.areas[0], time.Now().UTC().AddDate(0, 0, 1))
+	if want, got := 1, len(digests); want != got {
+		t.Fatalf("Expected %d digest, got %d", want, got)
+	}
+	digest := digests[0]
+	if want, got := 1, len(digest.Digest); want != got {
+		t.Errorf("Expected %d digest entries, got %d", want, got)
+	}
+	if want, got := `"Beepo" logged Needs Maintenance on "Bingo Hall".`, digest.toString(500); !strings.Contains(got, want) {
+		t.Errorf("Expected the digest to contain %q, got %q", want, got)
+	}
+	// Once it's been posted, there's nothing left for the next digest.
+	if digests := g.buildDigests(context.Background(), &g.areas[0], time.Now().UTC().AddDate(0, 0, 2)); len(digests) != 0 {
+		t.Errorf("Didn't expect another digest")
+	}
+}
+
+func TestDigestSplitting(t *testing.T) {
+	tempdir := t.TempDir()
+	conf := configStore{
+		SearchTerms: searchTerms{
+			AreaName: "Blerpville",
+		},
+		DBFilename: tempdir + "/test.sqlite3",
+	}
+	api := &mockGeocachingApi{}
+	api.populate()
+	g, err := NewGeocaching(context.Background(), conf, api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// A busy day's worth of entries won't fit in one post.
+	loggedAt := time.Now().UTC()
+	for i := 0; i < 20; i++ {
+		post := postDetails{
+			AreaName:  "Blerpville",
+			Kind:      kindNeedsMaintenance,
+			LogType:   "Needs Maintenance",
+			UserName:  fmt.Sprintf("Finder %d", i),
+			CacheName: fmt.Sprintf("Cache number %d", i),
+		}
+		if err := g.db.AddDigestEntry(post, loggedAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	digests := g.buildDigests(context.Background(), &g.areas[0], loggedAt.AddDate(0, 0, 1))
+	if len(digests) < 2 {
+		t.Fatalf("Expected the digest to be split, got %d posts", len(digests))
+	}
+	// Every entry should make it into a post whole.
+	var text string
+	for _, digest := range digests {
+		post := digest.toString(500)
+		if strings.Contains(post, elipsis) {
+			t.Errorf("Expected the digest not to be shortened, got %q", post)
+		}
+		text += post
+	}
+	for i := 0; i < 20; i++ {
+		if want := fmt.Sprintf(`"Finder %d" logged Needs Maintenance on "Cache number %d".`, i, i); !strings.Contains(text, want) {
+			t.Errorf("Expected the digests to contain %q", want)
+		}
+	}
+	if digests := g.buildDigests(context.Background(), &g.areas[0], loggedAt.AddDate(0, 0, 2)); len(digests) != 0 {
+		t.Errorf("Didn't expect another digest")
+	}
+}
+
+func TestUpdateMultipleLogs(t *testing.T) {
+	var err error
+	tempdir := t.TempDir()
+	conf := configStore{
+		SearchTerms: searchTerms{
+			AreaName: "Blerpville",
+		},
+		DBFilename: tempdir + "/test.sqlite3",
+	}
+	var g *Geocaching
+	api := &mockGeocachingApi{}
+	api.populate()
+	if g, err = NewGeocaching(context.Background(), conf, api); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	api.advanceLastFoundDate(1)
+	if _, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Three people find the cache between polls.
+	api.addLog(1, "Amy")
+	api.addLog(1, "Bob")
+	api.advanceLastFoundDate(1)
+	posts, err := g.Update(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, len(posts); want != got {
+		t.Fatalf("Expected %d posts, got %d", want, got)
+	}
+	for i, name := range []string{"Amy", "Bob", "Bob"} {
+		if want, got := name, posts[i].UserName; want != got {
+			t.Errorf("Expected post %d to be by %s, got %s", i, want, got)
+		}
+	}
+	if want, got := 2, posts[2].UsersFindsToday; want != got {
+		t.Errorf("Expected %d finds today, got %d", want, got)
+	}
+
+	// Nothing new has been logged, so nothing should be posted again.
+	api.caches[1].LastFoundTime = api.caches[1].LastFoundTime.Add(time.Hour)
+	if posts, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(posts); want != got {
+		t.Errorf("Expected %d posts, got %d", want, got)
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+	var err error
+	tempdir := t.TempDir()
+	conf := configStore{
+		SearchTerms: searchTerms{
+			AreaName: "Blerpville",
+		},
+		DBFilename: tempdir + "/test.sqlite3",
+	}
+	var g *Geocaching
+	api := &mockGeocachingApi{}
+	api.populate()
+	if g, err = NewGeocaching(context.Background(), conf, api); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// If we're rate limited we stop, and try the same cache again next time.
+	api.advanceLastFoundDate(0)
+	api.advanceLastFoundDate(1)
+	api.logsErr = fmt.Errorf("%w, retry after 120", ErrRateLimited)
+	posts, err := g.Update(context.Background())
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected %v, got %v", ErrRateLimited, err)
+	}
+	if want, got := 0, len(posts); want != got {
+		t.Errorf("Expected %d posts, got %d", want, got)
+	}
+	api.logsErr = nil
+	if posts, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(posts); want != got {
+		t.Errorf("Expected %d posts, got %d", want, got)
+	}
+
+	// Premium caches are skipped, and not tried again.
+	api.advanceLastFoundDate(0)
+	api.logsErr = ErrPremiumOnly
+	if posts, err = g.Update(context.Background()); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if want, got := 0, len(posts); want != got {
+		t.Errorf("Expected %d posts, got %d", want, got)
+	}
+	api.logsErr = nil
+	if posts, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(posts); want != got {
+		t.Errorf("Expected %d posts, got %d", want, got)
+	}
+}
+
+func TestUpdateCancelled(t *testing.T) {
+	var err error
+	tempdir := t.TempDir()
+	conf := configStore{
+		SearchTerms: searchTerms{
+			AreaName: "Blerpville",
+		},
+		DBFilename: tempdir + "/test.sqlite3",
+	}
+	var g *Geocaching
+	api := &mockGeocachingApi{}
+	api.populate()
+	if g, err = NewGeocaching(context.Background(), conf, api); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cancelled update stops without recording anything, so nothing is missed.
+	api.advanceLastFoundDate(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = g.Update(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	posts, err := g.Update(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(posts); want != got {
+		t.Errorf("Expected %d posts, got %d", want, got)
+	}
+}
+
+func TestUpdateSearchAreas(t *testing.T) {
+	var err error
+	tempdir := t.TempDir()
+	conf := configStore{
+		SearchAreas: []searchTerms{
+			{AreaName: "Northville", Publishers: []string{"north"}},
+			{AreaName: "Southville", Publishers: []string{"south"}},
+		},
+		DBFilename: tempdir + "/test.sqlite3",
+	}
+	var g *Geocaching
+	api := &mockGeocachingApi{}
+	api.populate()
+	api.areas = map[string][]string{
+		"Northville": {"GC1234"},
+		"Southville": {"GC1234", "GC456798"},
+	}
+	if g, err = NewGeocaching(context.Background(), conf, api); err != nil {
+		t.Fatal(err)
+	}
+	var posts []postDetails
+	if posts, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(posts); want != got {
+		t.Errorf("Expected %d posts, got %d", want, got)
+	}
+
+	// A new cache is posted under the area it's in.
+	api.addCache(1, "GC9999")
+	api.areas["Southville"] = append(api.areas["Southville"], "GC9999")
+	if posts, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(posts); want != got {
+		t.Fatalf("Expected %d posts, got %d", want, got)
+	}
+	if want, got := "Southville", posts[0].AreaName; want != got {
+		t.Errorf("Expected the area to be %s, got %s", want, got)
+	}
+	if want, got := "[south]", fmt.Sprint(posts[0].Publishers); want != got {
+		t.Errorf("Expected the post to go to %s, got %s", want, got)
+	}
+
+	// A log on a cache in both areas is only posted once, but goes to both areas' publishers.
+	api.advanceLastFoundDate(0)
+	if posts, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(posts); want != got {
+		t.Fatalf("Expected %d posts, got %d", want, got)
+	}
+	if want, got := "Northville", posts[0].AreaName; want != got {
+		t.Errorf("Expected the area to be %s, got %s", want, got)
+	}
+	if want, got := "[north south]", fmt.Sprint(posts[0].Publishers); want != got {
+		t.Errorf("Expected the post to go to %s, got %s", want, got)
+	}
+	g.Close()
+
+	// Adding an area later doesn't announce everything that's already in it.
+	conf.SearchAreas = append(conf.SearchAreas, searchTerms{AreaName: "Eastville"})
+	api.addCache(1, "GC8888")
+	api.areas["Eastville"] = []string{"GC456798", "GC8888"}
+	if g, err = NewGeocaching(context.Background(), conf, api); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if posts, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, len(posts); want != got {
+		t.Errorf("Expected %d posts, got %d", want, got)
+	}
+	api.addCache(1, "GC7777")
+	api.areas["Eastville"] = append(api.areas["Eastville"], "GC7777")
+	if posts, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(posts); want != got {
+		t.Fatalf("Expected %d posts, got %d", want, got)
+	}
+	if want, got := 0, len(posts[0].Publishers); want != got {
+		t.Errorf("Expected the post to go to every publisher, got %v", posts[0].Publishers)
+	}
+}
+
+func TestUpdateLegacyArea(t *testing.T) {
+	var err error
+	tempdir := t.TempDir()
+	conf := configStore{
+		SearchTerms: searchTerms{AreaName: "Northville"},
+		DBFilename:  tempdir + "/test.sqlite3",
+	}
+	var g *Geocaching
+	api := &mockGeocachingApi{}
+	api.populate()
+	if g, err = NewGeocaching(context.Background(), conf, api); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Databases from before search areas don't record which areas they've seen.
+	g.db.db.Exec("DELETE FROM search_areas")
+	if _, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	g.Close()
+
+	// Adding a second area shouldn't make the first one look new, even once the
+	// second one has been seen.
+	conf.SearchAreas = []searchTerms{conf.SearchTerms, {AreaName: "Southville"}}
+	api.areas = map[string][]string{
+		"Northville": {"GC1234", "GC456798"},
+		"Southville": {},
+	}
+	if g, err = NewGeocaching(context.Background(), conf, api); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	api.addCache(1, "GC9999")
+	api.areas["Northville"] = append(api.areas["Northville"], "GC9999")
+	posts, err := g.Update(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(posts); want != got {
+		t.Fatalf("Expected %d posts, got %d", want, got)
+	}
+	if want, got := "GC9999", posts[0].CacheCode; want != got {
+		t.Errorf("Expected a post about %s, got %s", want, got)
+	}
+}
+
+func TestUpdateBoundary(t *testing.T) {
+	var err error
+	tempdir := t.TempDir()
+	// A square around the mock caches.
+	boundary := `{"type": "Polygon", "coordinates": [[[-122.5, 37.7], [-122.3, 37.7], [-122.3, 37.8], [-122.5, 37.8], [-122.5, 37.7]]]}`
+	if err = os.WriteFile(tempdir+"/boundary.geojson", []byte(boundary), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := configStore{
+		SearchTerms: searchTerms{
+			AreaName:     "Blerpville",
+			BoundaryFile: tempdir + "/boundary.geojson",
+		},
+		DBFilename: tempdir + "/test.sqlite3",
+	}
+	var g *Geocaching
+	api := &mockGeocachingApi{}
+	api.populate()
+	if g, err = NewGeocaching(context.Background(), conf, api); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the cache inside the boundary is posted about.
+	api.addCache(0, "GC9999")
+	api.addCache(0, "GC8888")
+	api.caches[len(api.caches)-1].PostedCoordinates.Latitude = 37.9
+	posts, err := g.Update(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(posts); want != got {
+		t.Fatalf("Expected %d posts, got %d", want, got)
+	}
+	if want, got := "GC9999", posts[0].CacheCode; want != got {
+		t.Errorf("Expected a post about %s, got %s", want, got)
+	}
+}
+
+func TestUpdateStatusChanges(t *testing.T) {
+	var err error
+	tempdir := t.TempDir()
+	conf := configStore{
+		SearchTerms: searchTerms{
+			AreaName: "Blerpville",
+		},
+		DBFilename: tempdir + "/test.sqlite3",
+		LogTypes: map[string]string{
+			kindCacheEnabled:    policyPost,
+			kindCacheMissing:    policyPost,
+			kindCacheReappeared: policyPost,
+		},
+	}
+	var g *Geocaching
+	api := &mockGeocachingApi{}
+	api.populate()
+	if g, err = NewGeocaching(context.Background(), conf, api); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, err = g.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	update := func(kind string) {
+		t.Helper()
+		posts, err := g.Update(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind == "" {
+			if want, got := 0, len(posts); want != got {
+				t.Errorf("Expected %d posts, got %d", want, got)
+			}
+			return
+		}
+		if want, got := 1, len(posts); want != got {
+			t.Fatalf("Expected %d posts, got %d", want, got)
+		}
+		if want, got := kind, posts[0].Kind; want != got {
+			t.Errorf("Expected a %s post, got %s", want, got)
+		}
+	}
+
+	// The mock caches start off disabled.
+	api.caches[0].CacheStatus = StatusActive
+	update(kindCacheEnabled)
+	api.caches[0].CacheStatus = StatusArchived
+	update(kindCacheArchived)
+	update("")
+	changes := g.db.StatusHistory("GC1234")
+	if want, got := 2, len(changes); want != got {
+		t.Fatalf("Expected %d status changes, got %d", want, got)
+	}
+	if want, got := StatusActive, changes[1].From; want != got {
+		t.Errorf("Expected the change to be from %s, got %s", want, got)
+	}
+	if want, got := StatusArchived, changes[1].To; want != got {
+		t.Errorf("Expected the change to be to %s, got %s", want, got)
+	}
+
+	// A cache that stops showing up is noticed once, and again if it comes back.
+	bingoHall := api.caches[1]
+	api.caches = api.caches[:1]
+	posts, err := g.Update(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(posts); want != got {
+		t.Fatalf("Expected %d posts, got %d", want, got)
+	}
+	if want, got := `The "Bingo Hall" geocache has disappeared from Blerpville`, posts[0].toString(500); !strings.Contains(got, want) {
+		t.Errorf("Expected the post to contain %q, got %q", want, got)
+	}
+	update("")
+	api.caches = append(api.caches, bingoHall)
+	update(kindCacheReappeared)
+
+	// Disabling goes into the digest by default.
+	api.caches[1].CacheStatus = StatusActive
+	update(kindCacheEnabled)
+	api.caches[1].CacheStatus = StatusDisabled
+	update("")
+	digests := g.buildDigests(context.Background(), &g.areas[0], time.Now().UTC().AddDate(0, 0, 1))
+	if want, got := 1, len(digests); want != got {
+		t.Fatalf("Expected %d digest, got %d", want, got)
+	}
+	if want, got := `"Bingo Hall" was disabled.`, digests[0].toString(500); !strings.Contains(got, want) {
+		t.Errorf("Expected the digest to contain %q, got %q", want, got)
+	}
+}
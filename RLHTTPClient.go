@@ -2,24 +2,70 @@ package main
 
 import (
 	"context"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
 )
 
 // Credit to Melchi Salins for the original code
 //https://medium.com/mflow/rate-limiting-in-golang-http-client-a22fba15861a
 
-// RLHTTPClient Rate Limited HTTP Client
+// How far we'll slow down when the server pushes back, and the longest
+// Retry-After we'll honour.
+const (
+	maxRequestInterval = 2 * time.Minute
+	maxRetryAfter      = time.Hour
+)
+
+// RLHTTPClient Rate Limited HTTP Client. If the server tells us to slow down with a
+// 429 or 503 it doubles the time between requests, and waits out any Retry-After
+// before sending another. Each successful request after that speeds it back up a
+// little, until it's back to the normal rate.
 type RLHTTPClient struct {
 	client      *http.Client
 	Ratelimiter *rate.Limiter
+
+	baseInterval time.Duration // The time between requests when all is well. 0 means no limit.
+	mu           sync.Mutex
+	interval     time.Duration // The time between requests right now.
+	pausedUntil  time.Time     // Don't send anything before this.
+}
+
+// This returns a client that sends at most one request every interval. An
+// interval of 0 turns off rate limiting, backing off and jitter entirely.
+func NewRLHTTPClient(client *http.Client, interval time.Duration) *RLHTTPClient {
+	c := &RLHTTPClient{
+		client:       client,
+		baseInterval: interval,
+		interval:     interval,
+	}
+	if interval > 0 {
+		c.Ratelimiter = rate.NewLimiter(rate.Every(interval), 1)
+	} else {
+		c.Ratelimiter = rate.NewLimiter(rate.Inf, 1)
+	}
+	return c
 }
 
 // Do dispatches the HTTP request to the network
 func (c *RLHTTPClient) Do(req *http.Request) (*http.Response, error) {
-	// Comment out the below 5 lines to turn off ratelimiting
-	ctx := context.Background()
+	ctx := req.Context()
+	c.mu.Lock()
+	wait := time.Until(c.pausedUntil)
+	c.mu.Unlock()
+	if wait > 0 {
+		log.Debug("Waiting ", wait.Round(time.Second), " before sending another request")
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 	err := c.Ratelimiter.Wait(ctx) // This is a blocking call. Honors the rate limit
 	if err != nil {
 		return nil, err
@@ -28,5 +74,70 @@ func (c *RLHTTPClient) Do(req *http.Request) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
+	c.adapt(resp)
 	return resp, nil
 }
+
+// This adjusts our rate based on how the server responded.
+func (c *RLHTTPClient) adapt(resp *http.Response) {
+	if c.baseInterval == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		c.interval *= 2
+		if c.interval > maxRequestInterval {
+			c.interval = maxRequestInterval
+		}
+		if retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); retryAfter > 0 {
+			c.pausedUntil = time.Now().Add(retryAfter)
+		}
+		log.Warn("Server said ", resp.Status, ", slowing down to one request every ", c.interval)
+	case resp.StatusCode < 400 && c.interval > c.baseInterval:
+		c.interval -= c.interval / 10
+		if c.interval < c.baseInterval {
+			c.interval = c.baseInterval
+		}
+	default:
+		return
+	}
+	c.Ratelimiter.SetLimit(rate.Every(c.interval))
+}
+
+// This returns how long a Retry-After header asks us to wait. It can either be a
+// number of seconds or a date. It returns 0 if the header is missing or invalid.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(header); err == nil {
+		wait = t.Sub(now)
+	}
+	if wait < 0 {
+		return 0
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
+
+// This waits a random time between min and max, so our requests aren't spaced
+// suspiciously evenly. It doesn't wait at all if rate limiting is turned off. It
+// returns early with ctx's error if ctx is cancelled.
+func (c *RLHTTPClient) Jitter(ctx context.Context, min, max time.Duration) error {
+	if c.baseInterval == 0 || max <= min {
+		return ctx.Err()
+	}
+	select {
+	case <-time.After(min + time.Duration(rand.Int63n(int64(max-min)))):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 3, 16, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"Thu, 16 Mar 2023 12:05:00 GMT", 5 * time.Minute},
+		{"Thu, 16 Mar 2023 11:55:00 GMT", 0},
+		{"-5", 0},
+		{"86400", maxRetryAfter},
+		{"soon", 0},
+	} {
+		if want, got := test.want, parseRetryAfter(test.header, now); want != got {
+			t.Errorf("Expected Retry-After %q to be %s, got %s", test.header, want, got)
+		}
+	}
+}
+
+func TestRLHTTPClientAdapts(t *testing.T) {
+	status := http.StatusOK
+	retryAfter := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	base := 10 * time.Millisecond
+	c := NewRLHTTPClient(&http.Client{}, base)
+	get := func() {
+		t.Helper()
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// Being told to slow down doubles the interval each time.
+	status = http.StatusTooManyRequests
+	get()
+	get()
+	if want, got := 4*base, c.interval; want != got {
+		t.Errorf("Expected the interval to be %s, got %s", want, got)
+	}
+
+	// It gradually speeds back up again, but no faster than normal.
+	status = http.StatusOK
+	get()
+	if want, got := 4*base-4*base/10, c.interval; want != got {
+		t.Errorf("Expected the interval to be %s, got %s", want, got)
+	}
+	for i := 0; i < 20; i++ {
+		get()
+	}
+	if want, got := base, c.interval; want != got {
+		t.Errorf("Expected the interval to be back to %s, got %s", want, got)
+	}
+
+	// A Retry-After holds off the next request.
+	status = http.StatusServiceUnavailable
+	retryAfter = "1"
+	get()
+	status = http.StatusOK
+	retryAfter = ""
+	start := time.Now()
+	get()
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Expected to wait out the Retry-After, only waited %s", elapsed)
+	}
+}
+
+func TestRLHTTPClientUnthrottled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	c := NewRLHTTPClient(&http.Client{}, 0)
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if !c.pausedUntil.IsZero() {
+		t.Errorf("Expected an unthrottled client to ignore Retry-After")
+	}
+}
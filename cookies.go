@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// This is a cookie jar that keeps a copy of the cookies gc.com sets so they can be
+// saved to disk and loaded again after a restart. The standard library's jar
+// doesn't let us get at the cookies' expiry dates, so we track them ourselves.
+type persistentJar struct {
+	jar     *cookiejar.Jar
+	site    *url.URL
+	mu      sync.Mutex
+	cookies map[string]*http.Cookie
+	changed bool // The cookies have changed since they were last saved or loaded.
+}
+
+func newPersistentJar(site string) (*persistentJar, error) {
+	var err error
+	j := &persistentJar{cookies: make(map[string]*http.Cookie)}
+	if j.jar, err = cookiejar.New(nil); err != nil {
+		return nil, err
+	}
+	if j.site, err = url.Parse(site); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *persistentJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+	if u.Hostname() != j.site.Hostname() {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	for _, c := range cookies {
+		c := *c
+		if c.MaxAge > 0 {
+			c.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+			c.MaxAge = 0
+		}
+		old, ok := j.cookies[c.Name]
+		if c.MaxAge < 0 || (!c.Expires.IsZero() && c.Expires.Before(now)) {
+			if ok {
+				delete(j.cookies, c.Name)
+				j.changed = true
+			}
+			continue
+		}
+		if !ok || old.Value != c.Value || expiryMoved(old.Expires, c.Expires) {
+			j.changed = true
+		}
+		j.cookies[c.Name] = &c
+	}
+}
+
+// A session that's extended on every request gets a new expiry each time, so we
+// ignore small changes rather than saving the cookies after every request.
+func expiryMoved(old, new time.Time) bool {
+	d := new.Sub(old)
+	return d > time.Hour || d < -time.Hour
+}
+
+// This returns true if the cookies have changed since they were last saved or loaded.
+func (j *persistentJar) Changed() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.changed
+}
+
+func (j *persistentJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// This writes the cookies out to a file that only we can read, since they're as
+// good as a password.
+func (j *persistentJar) Save(filename string) error {
+	j.mu.Lock()
+	cookies := make([]*http.Cookie, 0, len(j.cookies))
+	for _, c := range j.cookies {
+		cookies = append(cookies, c)
+	}
+	j.changed = false
+	j.mu.Unlock()
+	b, err := json.Marshal(cookies)
+	if err == nil {
+		err = writeFileAtomic(filename, b)
+	}
+	if err != nil {
+		j.mu.Lock()
+		j.changed = true
+		j.mu.Unlock()
+	}
+	return err
+}
+
+// This replaces the file with b, by writing to a temporary file and renaming it
+// over the top, so a crash can't leave half a file behind. The file can only be
+// read by its owner.
+func writeFileAtomic(filename string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	// CreateTemp makes the file with 0600 permissions.
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// This loads cookies saved by Save, skipping any that have expired. It returns
+// the number of cookies loaded. It refuses to load a file that other users can
+// read or write.
+func (j *persistentJar) Load(filename string) (int, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return 0, fmt.Errorf("%s has permissions %s, it should only be accessible by its owner", filename, info.Mode().Perm())
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var saved []*http.Cookie
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return 0, err
+	}
+	var cookies []*http.Cookie
+	for _, c := range saved {
+		if !c.Expires.IsZero() && c.Expires.Before(time.Now()) {
+			continue
+		}
+		cookies = append(cookies, c)
+	}
+	j.SetCookies(j.site, cookies)
+	j.mu.Lock()
+	j.changed = false
+	j.mu.Unlock()
+	return len(cookies), nil
+}
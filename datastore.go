@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"text/template"
+	"time"
 
 	"github.com/pelletier/go-toml/v2"
 )
@@ -12,6 +15,18 @@ type searchTerms struct {
 	RadiusMeters  int
 	AreaName      string
 	IgnorePremium bool
+	// The names of the publishers that posts about this area go to. Empty means all of them.
+	Publishers []string
+	// Which of the caches in the area we're interested in. See filters.go.
+	Filters searchFilters
+	// A GeoJSON file with the area's boundary in it. If this is set the latitude,
+	// longitude and radius are ignored.
+	BoundaryFile string
+	boundary     []polygon // The polygons loaded from BoundaryFile.
+	// The IANA time zone the area is in, E.G. "Australia/Brisbane". If this is
+	// empty we guess from the area's coordinates. See timezones.go.
+	TimeZone string
+	location *time.Location
 }
 
 type APIConfig struct {
@@ -19,17 +34,42 @@ type APIConfig struct {
 	GeocachingAPIURL string
 	HTTPProxyURL     string
 	UnThrottle       bool // Should we disable rate-limiting for this API?
+	// Where we save our login session between restarts. Leave empty to log in every time.
+	CookieFile string
+	// Where we remember how we've split up busy search areas. Leave empty to work it out again after every restart.
+	TileFile string
+	// How long to wait for a single request to gc.com. Zero uses the default of 60 seconds.
+	RequestTimeoutSeconds int
 }
 
 type configStore struct {
 	Configuration APIConfig
 	SearchTerms   searchTerms
-	DBFilename    string
+	// The areas to watch, if there's more than one. This replaces SearchTerms.
+	SearchAreas []searchTerms
+	DBFilename  string
+	Publishers  []publisherConfig
+	Templates   postTemplates
+	// What to do with each kind of log: "post", "ignore" or "digest". See logtypes.go.
+	LogTypes map[string]string
+	// The language to name cache types and sizes in, E.G. "de". The default is English.
+	Language string
+	// How long we spend sending queued posts when shutting down.
+	ShutdownTimeoutSeconds int
+}
+
+// This returns every area we should be watching.
+func (c *configStore) searchAreas() []searchTerms {
+	if len(c.SearchAreas) > 0 {
+		return c.SearchAreas
+	}
+	return []searchTerms{c.SearchTerms}
 }
 
 type config struct {
-	Filename string
-	Store    configStore
+	Filename  string
+	Store     configStore
+	Templates *template.Template // The compiled version of Store.Templates
 }
 
 // Write the current config out to a toml file.
@@ -65,5 +105,69 @@ func NewDatastore(filename string) (*config, error) {
 	if c.Store.DBFilename == "" {
 		c.Store.DBFilename = "cacheodon.sqlite3"
 	}
+	if c.Store.Configuration.CookieFile == "" {
+		c.Store.Configuration.CookieFile = "cacheodon.cookies"
+	}
+	if c.Store.Configuration.TileFile == "" {
+		c.Store.Configuration.TileFile = "cacheodon.tiles"
+	}
+	if c.Store.ShutdownTimeoutSeconds == 0 {
+		// Docker gives us 10 seconds to stop before killing us.
+		c.Store.ShutdownTimeoutSeconds = 8
+	}
+	if c.Store.Configuration.RequestTimeoutSeconds == 0 {
+		c.Store.Configuration.RequestTimeoutSeconds = 60
+	}
+	// If no publishers are configured, fall back to the original single
+	// Mastodon account configured through environment variables.
+	if len(c.Store.Publishers) == 0 {
+		c.Store.Publishers = []publisherConfig{{Name: "mastodon", Type: "mastodon"}}
+	}
+	var err error
+	if c.Templates, err = c.Store.Templates.compile(); err != nil {
+		return nil, err
+	}
+	if err = validateLogTypePolicies(c.Store.LogTypes); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i := range c.Store.Publishers {
+		if c.Store.Publishers[i].Name == "" {
+			c.Store.Publishers[i].Name = c.Store.Publishers[i].Type
+		}
+		if names[c.Store.Publishers[i].Name] {
+			return nil, fmt.Errorf("duplicate publisher name %q", c.Store.Publishers[i].Name)
+		}
+		names[c.Store.Publishers[i].Name] = true
+	}
+	if err = validateSearchAreas(c.Store.SearchAreas, names); err != nil {
+		return nil, err
+	}
+	for _, area := range c.Store.searchAreas() {
+		if err = area.Filters.validate(); err != nil {
+			return nil, fmt.Errorf("search area %q: %w", area.AreaName, err)
+		}
+	}
 	return c, nil
 }
+
+// This checks every area has a name of its own, since that's how we tell them apart
+// in the database, and that they only send posts to publishers that exist.
+func validateSearchAreas(areas []searchTerms, publishers map[string]bool) error {
+	names := make(map[string]bool)
+	for _, area := range areas {
+		if area.AreaName == "" {
+			return fmt.Errorf("every search area needs an AreaName")
+		}
+		if names[area.AreaName] {
+			return fmt.Errorf("duplicate search area name %q", area.AreaName)
+		}
+		names[area.AreaName] = true
+		for _, p := range area.Publishers {
+			if !publishers[p] {
+				return fmt.Errorf("search area %q posts to unknown publisher %q", area.AreaName, p)
+			}
+		}
+	}
+	return nil
+}
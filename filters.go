@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// These narrow down the caches we post about in a search area. Anything left
+// empty or zero doesn't filter at all.
+type searchFilters struct {
+	GeocacheTypes  []GeocacheType  // Only these cache types, E.G. "Event" or 6.
+	ContainerTypes []ContainerType // Only these sizes.
+	CacheStatuses  []CacheStatus   // Only caches with these statuses.
+	MinDifficulty  float64
+	MaxDifficulty  float64
+	MinTerrain     float64
+	MaxTerrain     float64
+	Owners         []string // Only caches hidden by these people.
+	ExcludeOwners  []string // Never caches hidden by these people.
+	// Only caches with all of these attributes, by ID.
+	Attributes []int
+	// Never caches with any of these attributes.
+	ExcludeAttributes []int
+}
+
+// This checks the filters make sense.
+func (f *searchFilters) validate() error {
+	if f.MaxDifficulty != 0 && f.MinDifficulty > f.MaxDifficulty {
+		return fmt.Errorf("MinDifficulty %.1f is more than MaxDifficulty %.1f", f.MinDifficulty, f.MaxDifficulty)
+	}
+	if f.MaxTerrain != 0 && f.MinTerrain > f.MaxTerrain {
+		return fmt.Errorf("MinTerrain %.1f is more than MaxTerrain %.1f", f.MinTerrain, f.MaxTerrain)
+	}
+	return nil
+}
+
+// This returns true if the cache gets through the filters.
+func (f *searchFilters) match(gc *Geocache) bool {
+	switch {
+	case len(f.GeocacheTypes) > 0 && !contains(f.GeocacheTypes, gc.GeocacheType):
+		return false
+	case len(f.ContainerTypes) > 0 && !contains(f.ContainerTypes, gc.ContainerType):
+		return false
+	case len(f.CacheStatuses) > 0 && !contains(f.CacheStatuses, gc.CacheStatus):
+		return false
+	case gc.Difficulty < f.MinDifficulty, f.MaxDifficulty != 0 && gc.Difficulty > f.MaxDifficulty:
+		return false
+	case gc.Terrain < f.MinTerrain, f.MaxTerrain != 0 && gc.Terrain > f.MaxTerrain:
+		return false
+	case len(f.Owners) > 0 && !containsName(f.Owners, gc.Owner.Username):
+		return false
+	case containsName(f.ExcludeOwners, gc.Owner.Username):
+		return false
+	}
+	for _, id := range f.Attributes {
+		if !gc.hasAttribute(id) {
+			return false
+		}
+	}
+	for _, id := range f.ExcludeAttributes {
+		if gc.hasAttribute(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// This returns the caches that get through the filters.
+func (f *searchFilters) filter(caches []Geocache) []Geocache {
+	var matched []Geocache
+	for i := range caches {
+		if f.match(&caches[i]) {
+			matched = append(matched, caches[i])
+		}
+	}
+	return matched
+}
+
+// This returns true if the cache has the attribute, and it applies. gc.com lists
+// some attributes as not applying, E.G. "not wheelchair accessible".
+func (gc *Geocache) hasAttribute(id int) bool {
+	for _, a := range gc.Attributes {
+		if a.ID == id && a.IsApplicable {
+			return true
+		}
+	}
+	return false
+}
+
+func contains[T comparable](list []T, v T) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+// gc.com usernames aren't case sensitive.
+func containsName(list []string, name string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestSearchFilters(t *testing.T) {
+	gc := Geocache{
+		Code:          "GC1234",
+		GeocacheType:  3,
+		ContainerType: 2,
+		CacheStatus:   0,
+		Difficulty:    2.5,
+		Terrain:       3,
+		Owner:         GeocacheOwner{Username: "JimblyBimbly"},
+		Attributes: []GeocacheAttributes{
+			{ID: 24, Name: "Wheelchair accessible", IsApplicable: false},
+			{ID: 8, Name: "Scenic view", IsApplicable: true},
+		},
+	}
+	for _, test := range []struct {
+		name    string
+		filters searchFilters
+		want    bool
+	}{
+		{"none", searchFilters{}, true},
+		{"type", searchFilters{GeocacheTypes: []GeocacheType{MultiCache, EventCache}}, true},
+		{"wrong type", searchFilters{GeocacheTypes: []GeocacheType{EventCache}}, false},
+		{"container", searchFilters{ContainerTypes: []ContainerType{SmallContainer}}, false},
+		{"status", searchFilters{CacheStatuses: []CacheStatus{StatusDisabled}}, false},
+		{"difficulty", searchFilters{MinDifficulty: 2, MaxDifficulty: 2.5}, true},
+		{"too easy", searchFilters{MinDifficulty: 3}, false},
+		{"too hard", searchFilters{MaxDifficulty: 2}, false},
+		{"terrain", searchFilters{MinTerrain: 3}, true},
+		{"too steep", searchFilters{MaxTerrain: 2.5}, false},
+		{"owner", searchFilters{Owners: []string{"jimblybimbly"}}, true},
+		{"other owner", searchFilters{Owners: []string{"PrinceOfBingo"}}, false},
+		{"excluded owner", searchFilters{ExcludeOwners: []string{"JimblyBimbly"}}, false},
+		{"attribute", searchFilters{Attributes: []int{8}}, true},
+		{"attribute that doesn't apply", searchFilters{Attributes: []int{24}}, false},
+		{"excluded attribute", searchFilters{ExcludeAttributes: []int{8}}, false},
+		{"excluded attribute that doesn't apply", searchFilters{ExcludeAttributes: []int{24}}, true},
+	} {
+		if want, got := test.want, test.filters.match(&gc); want != got {
+			t.Errorf("%s: expected %v, got %v", test.name, want, got)
+		}
+	}
+
+	if err := (&searchFilters{MinTerrain: 4, MaxTerrain: 2}).validate(); err == nil {
+		t.Errorf("Expected an error for an impossible terrain range")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// These are gc.com's codes for the kinds of geocache, container and status. Each
+// type keeps codes it doesn't know about, so a cache passes through us unchanged
+// when gc.com adds a new one. In JSON they're written as gc.com's numbers, but
+// can be read from either the number or the name, as can the config.
+
+type GeocacheType int
+
+const (
+	TraditionalCache     GeocacheType = 2
+	MultiCache           GeocacheType = 3
+	VirtualCache         GeocacheType = 4
+	LetterboxHybrid      GeocacheType = 5
+	EventCache           GeocacheType = 6
+	MysteryCache         GeocacheType = 8
+	WebcamCache          GeocacheType = 11
+	CITOEvent            GeocacheType = 13
+	EarthCache           GeocacheType = 137
+	MegaEvent            GeocacheType = 453
+	WherigoCache         GeocacheType = 1858
+	CommunityCelebration GeocacheType = 3653
+	GigaEvent            GeocacheType = 7005
+)
+
+var geocacheTypeNames = map[GeocacheType]string{
+	TraditionalCache:     "Traditional cache",
+	MultiCache:           "Multi-cache",
+	VirtualCache:         "Virtual cache",
+	LetterboxHybrid:      "Letterbox hybrid",
+	EventCache:           "Event",
+	MysteryCache:         "Mystery cache",
+	WebcamCache:          "Webcam cache",
+	CITOEvent:            "CITO event",
+	EarthCache:           "EarthCache",
+	MegaEvent:            "Mega-Event",
+	WherigoCache:         "Wherigo cache",
+	CommunityCelebration: "Community Celebration event",
+	GigaEvent:            "Giga-Event",
+}
+
+var geocacheTypeEmoji = map[GeocacheType]string{
+	TraditionalCache:     "📦",
+	MultiCache:           "🔢",
+	VirtualCache:         "👻",
+	LetterboxHybrid:      "✉️",
+	EventCache:           "📅",
+	MysteryCache:         "❓",
+	WebcamCache:          "📷",
+	CITOEvent:            "🗑️",
+	EarthCache:           "🪨",
+	MegaEvent:            "📅",
+	WherigoCache:         "🧭",
+	CommunityCelebration: "🎂",
+	GigaEvent:            "📅",
+}
+
+// This returns the type's English name, or "Geocache" if we don't know it.
+func (t GeocacheType) String() string {
+	return t.Name("en")
+}
+
+// This returns the type's name in the given language, falling back to English.
+func (t GeocacheType) Name(lang string) string {
+	if name, ok := localizedGeocacheTypeNames[lang][t]; ok {
+		return name
+	}
+	if name, ok := geocacheTypeNames[t]; ok {
+		return name
+	}
+	return localizedName(lang, "Geocache")
+}
+
+func (t GeocacheType) Emoji() string {
+	if emoji, ok := geocacheTypeEmoji[t]; ok {
+		return emoji
+	}
+	return "🌏"
+}
+
+// This returns true if the geocache is an event of some sort.
+func (t GeocacheType) IsEvent() bool {
+	switch t {
+	case EventCache, CITOEvent, MegaEvent, CommunityCelebration, GigaEvent:
+		return true
+	}
+	return false
+}
+
+func (t *GeocacheType) UnmarshalText(text []byte) error {
+	code, err := parseCode(string(text), geocacheTypeNames, "geocache type")
+	*t = GeocacheType(code)
+	return err
+}
+
+func (t *GeocacheType) UnmarshalJSON(b []byte) error {
+	return unmarshalCodeJSON(b, t)
+}
+
+type ContainerType int
+
+const (
+	UnknownSize      ContainerType = 1
+	MicroContainer   ContainerType = 2
+	RegularContainer ContainerType = 3
+	LargeContainer   ContainerType = 4
+	VirtualContainer ContainerType = 5
+	OtherContainer   ContainerType = 6
+	SmallContainer   ContainerType = 8
+)
+
+var containerTypeNames = map[ContainerType]string{
+	UnknownSize:      "Unknown size",
+	MicroContainer:   "Micro",
+	RegularContainer: "Regular",
+	LargeContainer:   "Large",
+	VirtualContainer: "Virtual",
+	OtherContainer:   "Other",
+	SmallContainer:   "Small",
+}
+
+var containerTypeEmoji = map[ContainerType]string{
+	MicroContainer:   "🤏",
+	SmallContainer:   "🥫",
+	RegularContainer: "📦",
+	LargeContainer:   "🧳",
+	VirtualContainer: "👻",
+}
+
+// This returns the size's English name, or "Unknown size" if we don't know it.
+func (c ContainerType) String() string {
+	return c.Name("en")
+}
+
+// This returns the size's name in the given language, falling back to English.
+func (c ContainerType) Name(lang string) string {
+	if name, ok := localizedContainerTypeNames[lang][c]; ok {
+		return name
+	}
+	if name, ok := containerTypeNames[c]; ok {
+		return name
+	}
+	return UnknownSize.Name(lang)
+}
+
+func (c ContainerType) Emoji() string {
+	if emoji, ok := containerTypeEmoji[c]; ok {
+		return emoji
+	}
+	return "❔"
+}
+
+func (c *ContainerType) UnmarshalText(text []byte) error {
+	code, err := parseCode(string(text), containerTypeNames, "container type")
+	*c = ContainerType(code)
+	return err
+}
+
+func (c *ContainerType) UnmarshalJSON(b []byte) error {
+	return unmarshalCodeJSON(b, c)
+}
+
+type CacheStatus int
+
+const (
+	StatusActive   CacheStatus = 0
+	StatusDisabled CacheStatus = 1
+	StatusArchived CacheStatus = 2
+)
+
+var cacheStatusNames = map[CacheStatus]string{
+	StatusActive:   "Active",
+	StatusDisabled: "Disabled",
+	StatusArchived: "Archived",
+}
+
+var cacheStatusEmoji = map[CacheStatus]string{
+	StatusActive:   "✅",
+	StatusDisabled: "⏸️",
+	StatusArchived: "🗄️",
+}
+
+// This returns the status's English name.
+func (s CacheStatus) String() string {
+	return s.Name("en")
+}
+
+// This returns the status's name in the given language, falling back to English.
+func (s CacheStatus) Name(lang string) string {
+	if name, ok := localizedCacheStatusNames[lang][s]; ok {
+		return name
+	}
+	if name, ok := cacheStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status %d", int(s))
+}
+
+func (s CacheStatus) Emoji() string {
+	return cacheStatusEmoji[s]
+}
+
+func (s *CacheStatus) UnmarshalText(text []byte) error {
+	code, err := parseCode(string(text), cacheStatusNames, "cache status")
+	*s = CacheStatus(code)
+	return err
+}
+
+func (s *CacheStatus) UnmarshalJSON(b []byte) error {
+	return unmarshalCodeJSON(b, s)
+}
+
+// This reads a code from either its number or its English name. Names aren't case
+// sensitive, and spaces and dashes are optional, so "multi cache", "Multi-cache"
+// and "MultiCache" are all 3.
+func parseCode[T ~int](text string, names map[T]string, what string) (T, error) {
+	if code, err := strconv.Atoi(strings.TrimSpace(text)); err == nil {
+		return T(code), nil
+	}
+	want := normaliseName(text)
+	for code, name := range names {
+		if normaliseName(name) == want {
+			return code, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown %s %q", what, text)
+}
+
+func normaliseName(name string) string {
+	return strings.NewReplacer(" ", "", "-", "", "_", "").Replace(strings.ToLower(name))
+}
+
+// This reads a code from JSON, as either a number or a name.
+func unmarshalCodeJSON(b []byte, code interface{ UnmarshalText([]byte) error }) error {
+	var text string
+	if string(b) == "null" {
+		return nil
+	}
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &text); err != nil {
+			return err
+		}
+	} else {
+		var n json.Number
+		if err := json.Unmarshal(b, &n); err != nil {
+			return err
+		}
+		text = n.String()
+	}
+	return code.UnmarshalText([]byte(text))
+}
+
+// Translations of the names above, by language code. Anything missing is in English.
+var localizedGeocacheTypeNames = map[string]map[GeocacheType]string{
+	"de": {
+		TraditionalCache: "Traditional Cache",
+		MultiCache:       "Multi-Cache",
+		VirtualCache:     "Virtueller Cache",
+		MysteryCache:     "Mystery Cache",
+		EventCache:       "Event",
+		WebcamCache:      "Webcam-Cache",
+		WherigoCache:     "Wherigo-Cache",
+	},
+	"fr": {
+		TraditionalCache: "Cache traditionnelle",
+		MultiCache:       "Multi-cache",
+		VirtualCache:     "Cache virtuelle",
+		MysteryCache:     "Cache mystère",
+		EventCache:       "Événement",
+		WebcamCache:      "Cache webcam",
+		WherigoCache:     "Cache Wherigo",
+	},
+}
+
+var localizedContainerTypeNames = map[string]map[ContainerType]string{
+	"de": {
+		UnknownSize:      "Unbekannte Größe",
+		MicroContainer:   "Mikro",
+		SmallContainer:   "Klein",
+		RegularContainer: "Normal",
+		LargeContainer:   "Groß",
+		VirtualContainer: "Virtuell",
+		OtherContainer:   "Andere",
+	},
+	"fr": {
+		UnknownSize:      "Taille inconnue",
+		MicroContainer:   "Micro",
+		SmallContainer:   "Petite",
+		RegularContainer: "Normale",
+		LargeContainer:   "Grande",
+		VirtualContainer: "Virtuelle",
+		OtherContainer:   "Autre",
+	},
+}
+
+var localizedCacheStatusNames = map[string]map[CacheStatus]string{
+	"de": {
+		StatusActive:   "Aktiv",
+		StatusDisabled: "Deaktiviert",
+		StatusArchived: "Archiviert",
+	},
+	"fr": {
+		StatusActive:   "Active",
+		StatusDisabled: "Désactivée",
+		StatusArchived: "Archivée",
+	},
+}
+
+// Anything else we need translated.
+var localizedNames = map[string]map[string]string{
+	"fr": {"Geocache": "Géocache"},
+}
+
+func localizedName(lang, name string) string {
+	if translated, ok := localizedNames[lang][name]; ok {
+		return translated
+	}
+	return name
+}
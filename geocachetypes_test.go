@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+func TestGeocacheTypeNames(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{MultiCache.String(), "Multi-cache"},
+		{MultiCache.Name("de"), "Multi-Cache"},
+		{LetterboxHybrid.Name("fr"), "Letterbox hybrid"},
+		{GeocacheType(9999).String(), "Geocache"},
+		{GeocacheType(9999).Name("fr"), "Géocache"},
+		{SmallContainer.String(), "Small"},
+		{SmallContainer.Name("de"), "Klein"},
+		{ContainerType(42).String(), "Unknown size"},
+		{StatusDisabled.String(), "Disabled"},
+		{CacheStatus(7).String(), "Status 7"},
+		{EventCache.Emoji(), "📅"},
+		{GeocacheType(9999).Emoji(), "🌏"},
+	} {
+		if want, got := test.want, test.name; want != got {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+	if !MegaEvent.IsEvent() || TraditionalCache.IsEvent() {
+		t.Errorf("Expected only events to be events")
+	}
+}
+
+func TestGeocacheTypeJSON(t *testing.T) {
+	var gc Geocache
+	in := `{"geocacheType": "multi cache", "containerType": 8, "cacheStatus": "Archived"}`
+	if err := json.Unmarshal([]byte(in), &gc); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := MultiCache, gc.GeocacheType; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := SmallContainer, gc.ContainerType; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := StatusArchived, gc.CacheStatus; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	// Codes we don't know about survive the round trip.
+	gc.GeocacheType = 9999
+	b, err := json.Marshal(gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Geocache
+	if err = json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := GeocacheType(9999), out.GeocacheType; want != got {
+		t.Errorf("Expected %d, got %d", want, got)
+	}
+	if want, got := SmallContainer, out.ContainerType; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	if err = json.Unmarshal([]byte(`{"geocacheType": "Blerpcache"}`), &out); err == nil {
+		t.Errorf("Expected an error for an unknown name")
+	}
+}
+
+func TestGeocacheTypeTOML(t *testing.T) {
+	var f searchFilters
+	in := `
+GeocacheTypes = ['Event', 'Mega-Event', 13]
+ContainerTypes = ['micro']
+CacheStatuses = [0]
+`
+	if err := toml.Unmarshal([]byte(in), &f); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "[Event Mega-Event CITO event]", fmt.Sprint(f.GeocacheTypes); want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "[Micro]", fmt.Sprint(f.ContainerTypes); want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := "[Active]", fmt.Sprint(f.CacheStatuses); want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
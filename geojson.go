@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// A polygon is a list of rings of [longitude, latitude] points, as in GeoJSON. The
+// first ring is the outside edge, and any others are holes in it.
+type polygon [][][2]float64
+
+// This is just enough of GeoJSON to get polygons out of it. Any of a
+// FeatureCollection, Feature, Polygon or MultiPolygon will do.
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Features    []geoJSON       `json:"features"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Geometries  []geoJSON       `json:"geometries"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// This returns every polygon in the GeoJSON.
+func (g *geoJSON) polygons() ([]polygon, error) {
+	var polygons []polygon
+	switch g.Type {
+	case "FeatureCollection":
+		for i := range g.Features {
+			p, err := g.Features[i].polygons()
+			if err != nil {
+				return nil, err
+			}
+			polygons = append(polygons, p...)
+		}
+	case "GeometryCollection":
+		for i := range g.Geometries {
+			p, err := g.Geometries[i].polygons()
+			if err != nil {
+				return nil, err
+			}
+			polygons = append(polygons, p...)
+		}
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, nil
+		}
+		return g.Geometry.polygons()
+	case "Polygon":
+		var p polygon
+		if err := json.Unmarshal(g.Coordinates, &p); err != nil {
+			return nil, err
+		}
+		polygons = append(polygons, p)
+	case "MultiPolygon":
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return nil, err
+		}
+	default:
+		// Points, lines and so on don't cover any area, so they're no use to us.
+	}
+	return polygons, nil
+}
+
+// This loads the polygons from a GeoJSON file.
+func loadGeoJSON(filename string) ([]polygon, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var g geoJSON
+	if err = json.Unmarshal(b, &g); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	polygons, err := g.polygons()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	for _, p := range polygons {
+		if len(p) == 0 || len(p[0]) < 3 {
+			return nil, fmt.Errorf("%s: a polygon needs at least three points", filename)
+		}
+	}
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("%s: no polygons found", filename)
+	}
+	return polygons, nil
+}
+
+// This returns true if the point is inside the polygon, and not in one of its holes.
+func (p polygon) contains(lat, lon float64) bool {
+	if len(p) == 0 || !ringContains(p[0], lat, lon) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if ringContains(hole, lat, lon) {
+			return false
+		}
+	}
+	return true
+}
+
+// This counts how many edges of the ring a line heading east from the point
+// crosses. If it's odd the point is inside.
+func ringContains(ring [][2]float64, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// This returns a circle that covers the whole polygon, for searching gc.com with.
+func (p polygon) coveringCircle() (lat, lon float64, radiusMeters int) {
+	minLat, minLon := math.Inf(1), math.Inf(1)
+	maxLat, maxLon := math.Inf(-1), math.Inf(-1)
+	for _, point := range p[0] {
+		minLon, maxLon = math.Min(minLon, point[0]), math.Max(maxLon, point[0])
+		minLat, maxLat = math.Min(minLat, point[1]), math.Max(maxLat, point[1])
+	}
+	lat, lon = (minLat+maxLat)/2, (minLon+maxLon)/2
+	var radius float64
+	for _, point := range p[0] {
+		radius = math.Max(radius, distanceMeters(lat, lon, point[1], point[0]))
+	}
+	// Round up, plus a bit, so the corners aren't lost to rounding.
+	return lat, lon, int(math.Ceil(radius)) + 1
+}
+
+// This loads the area's boundary, if it has one.
+func (st *searchTerms) loadBoundary() error {
+	if st.BoundaryFile == "" {
+		return nil
+	}
+	var err error
+	st.boundary, err = loadGeoJSON(st.BoundaryFile)
+	return err
+}
+
+// This returns the circles to search gc.com with to cover the area's boundary,
+// one for each polygon in it.
+func (st *searchTerms) searchCircles() []searchTerms {
+	var circles []searchTerms
+	for _, p := range st.boundary {
+		circle := *st
+		lat, lon, radius := p.coveringCircle()
+		circle.Latitude, circle.Longitude, circle.RadiusMeters = float32(lat), float32(lon), radius
+		circles = append(circles, circle)
+	}
+	return circles
+}
+
+// This returns true if the cache is inside the area's boundary. Every cache is,
+// if it doesn't have one.
+func (st *searchTerms) inBoundary(gc *Geocache) bool {
+	if len(st.boundary) == 0 {
+		return true
+	}
+	for _, p := range st.boundary {
+		if p.contains(gc.PostedCoordinates.Latitude, gc.PostedCoordinates.Longitude) {
+			return true
+		}
+	}
+	return false
+}
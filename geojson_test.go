@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// A square around Brisbane with a hole in the middle, and an island off to the east.
+const testBoundary = `{
+	"type": "FeatureCollection",
+	"features": [{
+		"type": "Feature",
+		"properties": {"name": "Brisbane"},
+		"geometry": {
+			"type": "MultiPolygon",
+			"coordinates": [
+				[
+					[[152.9, -27.6], [153.1, -27.6], [153.1, -27.4], [152.9, -27.4], [152.9, -27.6]],
+					[[152.99, -27.51], [153.01, -27.51], [153.01, -27.49], [152.99, -27.49], [152.99, -27.51]]
+				],
+				[
+					[[153.4, -27.5], [153.5, -27.5], [153.45, -27.4], [153.4, -27.5]]
+				]
+			]
+		}
+	}]
+}`
+
+func TestBoundary(t *testing.T) {
+	filename := t.TempDir() + "/boundary.geojson"
+	if err := os.WriteFile(filename, []byte(testBoundary), 0644); err != nil {
+		t.Fatal(err)
+	}
+	st := searchTerms{BoundaryFile: filename}
+	if err := st.loadBoundary(); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(st.boundary); want != got {
+		t.Fatalf("Expected %d polygons, got %d", want, got)
+	}
+	for _, test := range []struct {
+		name     string
+		lat, lon float64
+		want     bool
+	}{
+		{"inside", -27.45, 152.95, true},
+		{"in the hole", -27.5, 153.0, false},
+		{"outside", -27.7, 153.0, false},
+		{"on the island", -27.45, 153.45, true},
+		{"between", -27.45, 153.2, false},
+	} {
+		gc := Geocache{PostedCoordinates: GocachePostedCoordinates{Latitude: test.lat, Longitude: test.lon}}
+		if want, got := test.want, st.inBoundary(&gc); want != got {
+			t.Errorf("%s: expected %v, got %v", test.name, want, got)
+		}
+	}
+
+	// The circles we search with cover every corner of the polygons.
+	circles := st.searchCircles()
+	if want, got := 2, len(circles); want != got {
+		t.Fatalf("Expected %d circles, got %d", want, got)
+	}
+	for i, p := range st.boundary {
+		for _, point := range p[0] {
+			gc := Geocache{PostedCoordinates: GocachePostedCoordinates{Latitude: point[1], Longitude: point[0]}}
+			if !circles[i].contains(&gc) {
+				t.Errorf("Expected circle %d to cover %v", i, point)
+			}
+		}
+	}
+
+	if err := os.WriteFile(filename, []byte(`{"type": "Point", "coordinates": [153.0, -27.5]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.loadBoundary(); err == nil {
+		t.Errorf("Expected an error for a boundary with no polygons in it")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// These are the kinds of post we make. Each has its own template, and most
+// correspond to one or more gc.com log types.
+const (
+	kindFind             = "Find"
+	kindMilestone        = "Milestone" // A find that's a round number of finds for the finder.
+	kindNewCache         = "NewCache"
+	kindDNF              = "DNF"
+	kindNote             = "Note"
+	kindNeedsMaintenance = "NeedsMaintenance"
+	kindOwnerMaintenance = "OwnerMaintenance"
+	kindNeedsArchived    = "NeedsArchived"
+	kindArchive          = "Archive"
+	kindUnarchive        = "Unarchive"
+	kindDisable          = "Disable"
+	kindEnable           = "Enable"
+	kindWillAttend       = "WillAttend"
+	kindReviewerNote     = "ReviewerNote"
+	kindOther            = "Other"
+	kindDigest           = "Digest"
+
+	// These are for changes we notice in search results, rather than logs.
+	kindCacheDisabled   = "CacheDisabled"
+	kindCacheEnabled    = "CacheEnabled"
+	kindCacheArchived   = "CacheArchived"
+	kindCacheUnarchived = "CacheUnarchived"
+	kindCacheMissing    = "CacheMissing"    // The cache stopped showing up in searches.
+	kindCacheReappeared = "CacheReappeared" // A missing cache showed up again.
+)
+
+// This returns the kind of post a cache's status changing from one to the other
+// should make. It returns "" for changes we don't know how to describe.
+func statusChangeKind(from, to CacheStatus) string {
+	switch {
+	case to == StatusArchived:
+		return kindCacheArchived
+	case from == StatusArchived:
+		return kindCacheUnarchived
+	case to == StatusDisabled:
+		return kindCacheDisabled
+	case from == StatusDisabled && to == StatusActive:
+		return kindCacheEnabled
+	}
+	return ""
+}
+
+// How each status change is described in a digest.
+var statusChangeDescriptions = map[string]string{
+	kindCacheDisabled:   "was disabled",
+	kindCacheEnabled:    "was re-enabled",
+	kindCacheArchived:   "was archived",
+	kindCacheUnarchived: "was unarchived",
+	kindCacheMissing:    "disappeared",
+	kindCacheReappeared: "reappeared",
+}
+
+// The log type IDs used by gc.com, and the kind of post each should make.
+var logTypeKinds = map[int]string{
+	2:  kindFind, // Found it
+	3:  kindDNF,  // Didn't find it
+	4:  kindNote, // Write note
+	5:  kindArchive,
+	6:  kindArchive,
+	7:  kindNeedsArchived,
+	9:  kindWillAttend,
+	10: kindFind, // Attended
+	11: kindFind, // Webcam Photo Taken
+	12: kindUnarchive,
+	18: kindReviewerNote,
+	22: kindDisable,
+	23: kindEnable,
+	45: kindNeedsMaintenance,
+	46: kindOwnerMaintenance,
+	68: kindReviewerNote,
+}
+
+// The log type names used by gc.com, for logs with IDs we don't recognise.
+var logTypeNameKinds = map[string]string{
+	"found it":                    kindFind,
+	"didn't find it":              kindDNF,
+	"write note":                  kindNote,
+	"archive":                     kindArchive,
+	"needs archived":              kindNeedsArchived,
+	"will attend":                 kindWillAttend,
+	"attended":                    kindFind,
+	"webcam photo taken":          kindFind,
+	"unarchive":                   kindUnarchive,
+	"post reviewer note":          kindReviewerNote,
+	"temporarily disable listing": kindDisable,
+	"enable listing":              kindEnable,
+	"needs maintenance":           kindNeedsMaintenance,
+	"owner maintenance":           kindOwnerMaintenance,
+}
+
+// The names of the log types that count as finding a cache.
+var findLogTypeNames = []string{"Found it", "Attended", "Webcam Photo Taken"}
+
+// This returns the kind of post a log should make.
+func logKind(l *GeocacheLog) string {
+	if kind, ok := logTypeKinds[l.LogTypeID]; ok {
+		return kind
+	}
+	if kind, ok := logTypeNameKinds[strings.ToLower(strings.TrimSpace(l.LogType))]; ok {
+		return kind
+	}
+	return kindOther
+}
+
+// These are the things we can do with each kind of post.
+const (
+	policyPost   = "post"
+	policyIgnore = "ignore"
+	policyDigest = "digest" // Collect them up and post a summary once a day.
+)
+
+// What we do with each kind of post if the config doesn't say.
+var defaultLogTypePolicies = map[string]string{
+	kindFind:             policyPost,
+	kindNewCache:         policyPost,
+	kindDNF:              policyPost,
+	kindNote:             policyIgnore,
+	kindNeedsMaintenance: policyDigest,
+	kindOwnerMaintenance: policyDigest,
+	kindNeedsArchived:    policyPost,
+	kindArchive:          policyPost,
+	kindUnarchive:        policyPost,
+	kindDisable:          policyDigest,
+	kindEnable:           policyDigest,
+	kindWillAttend:       policyIgnore,
+	kindReviewerNote:     policyIgnore,
+	kindOther:            policyIgnore,
+	kindCacheDisabled:    policyDigest,
+	kindCacheEnabled:     policyDigest,
+	kindCacheArchived:    policyPost,
+	kindCacheUnarchived:  policyPost,
+	kindCacheMissing:     policyDigest,
+	kindCacheReappeared:  policyIgnore,
+}
+
+// This returns the policy for a kind of post.
+func (c *configStore) logTypePolicy(kind string) string {
+	if policy, ok := c.LogTypes[kind]; ok {
+		return policy
+	}
+	if policy, ok := defaultLogTypePolicies[kind]; ok {
+		return policy
+	}
+	return policyIgnore
+}
+
+// This checks the configured log type policies make sense.
+func validateLogTypePolicies(policies map[string]string) error {
+	for kind, policy := range policies {
+		if _, ok := defaultLogTypePolicies[kind]; !ok {
+			return fmt.Errorf("unknown log type %q in LogTypes", kind)
+		}
+		switch policy {
+		case policyPost, policyIgnore, policyDigest:
+		default:
+			return fmt.Errorf("unknown policy %q for log type %s, it should be %q, %q or %q", policy, kind, policyPost, policyIgnore, policyDigest)
+		}
+	}
+	return nil
+}
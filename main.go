@@ -1,17 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"math/rand"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func main() {
-	var err error
+// The exit codes we use.
+const (
+	exitOK = 0
+	// We couldn't start, E.G. because the config is broken or we couldn't log in.
+	exitFailure = 1
+	// We shut down cleanly, but couldn't send some posts in time. They're still
+	// queued and will be sent when we next start.
+	exitUndelivered = 2
+)
 
+func main() {
 	verbose := flag.Bool("v", false, "Verbose logging")
 
 	flag.Parse()
@@ -24,51 +37,103 @@ func main() {
 		FullTimestamp: true,
 	})
 
+	os.Exit(run())
+}
+
+// This runs the bot until it's asked to stop with SIGINT or SIGTERM, and returns
+// the exit code. It's separate from main so its deferred cleanup runs before we exit.
+func run() int {
+	var err error
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	config, err := NewDatastore("config.toml")
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		log.Error(err)
+		return exitFailure
 	}
 
 	var api GeocachingAPIer
 	if api, err = NewGeocachingAPI(config.Store.Configuration); err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		log.Error(err)
+		return exitFailure
 	}
 	var g *Geocaching
-	if g, err = NewGeocaching(config.Store, api); err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+	if g, err = NewGeocaching(ctx, config.Store, api); err != nil {
+		log.Error(err)
+		return exitFailure
 	}
 	defer g.Close()
-	var m *Mastodon
-	for {
-		if posts, err := g.Update(); err == nil {
-			for _, post := range posts {
-				if m == nil {
-					m, err = NewMastodon()
-					if err != nil {
-						log.Println(err)
-					}
-				}
-				if post.NewCache {
-					// Don't post about new caches yet.
-					continue
-				}
-				postString := post.toString()
-				// log.Println("Posted to Mastodon: " + postString)
-				if err := m.PostStatus(postString); err != nil {
-					log.Println(err)
-					m = nil
-				} else {
-					log.Println("Posted to Mastodon: " + postString)
-				}
-			}
-		} else {
+	var publishers []Publisher
+	if publishers, err = NewPublishers(config.Store.Publishers, config.Templates); err != nil {
+		log.Error(err)
+		return exitFailure
+	}
+	for _, p := range publishers {
+		defer p.Close()
+		if err := p.HealthCheck(ctx); err != nil {
+			log.Errorf("Publisher %s failed its health check: %s", p.Name(), err)
+		}
+	}
+	outbox := NewOutbox(g.db, publishers)
+	// Check what we've already posted so we don't repeat ourselves after a restart.
+	log.Println("Read back", outbox.Reconcile(ctx, 40), "statuses from our timelines")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		outbox.Run(ctx, 30*time.Second)
+	}()
+	if pending := g.db.PendingPostCount(); pending > 0 {
+		log.Println("Resuming delivery of", pending, "queued posts")
+	}
+	for ctx.Err() == nil {
+		posts, err := g.Update(ctx)
+		if err != nil && ctx.Err() == nil {
 			log.Println(err)
 		}
-		// Wait a random number of minutes between 3 and 8
-		time.Sleep(time.Duration(rand.Intn(5*60)+3*60) * time.Second)
+		if len(posts) > 0 {
+			// These finds are already recorded as seen, so they must be queued
+			// even if we're shutting down or they'll never be posted.
+			if err := outbox.Enqueue(context.Background(), posts); err != nil {
+				log.Error(err)
+			}
+			outbox.Kick()
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(pollDelay(err)):
+		}
 	}
 
+	// Let a second signal kill us straight away if shutting down takes too long.
+	stop()
+	log.Println("Shutting down")
+	wg.Wait()
+	timeout := time.Duration(config.Store.ShutdownTimeoutSeconds) * time.Second
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if undelivered := outbox.Drain(drainCtx); undelivered > 0 {
+		log.Warn("Couldn't send ", undelivered, " posts before shutting down, they'll be sent when we next start")
+		return exitUndelivered
+	}
+	return exitOK
+}
+
+// This returns how long to wait before polling again, given how the last poll went.
+func pollDelay(err error) time.Duration {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		// Back right off and give them a chance to forget about us.
+		log.Warn("Rate limited by gc.com, waiting a while before trying again")
+		return time.Duration(rand.Intn(15*60)+30*60) * time.Second
+	case errors.Is(err, ErrNotAuthenticated):
+		// Logging in again is already backing off, so there's no point polling
+		// before it's ready to try again.
+		return time.Duration(rand.Intn(5*60)+10*60) * time.Second
+	default:
+		// Wait a random number of minutes between 3 and 8
+		return time.Duration(rand.Intn(5*60)+3*60) * time.Second
+	}
 }
@@ -3,43 +3,144 @@ package main
 import (
 	"context"
 	"os"
+	"text/template"
+	"time"
 
 	"github.com/mattn/go-mastodon"
 )
 
+// The number of characters Mastodon allows in a post by default.
+const mastodonDefaultMaxLength = 500
+
 type Mastodon struct {
-	c *mastodon.Client
+	conf      publisherConfig
+	templates *template.Template
+	c         *mastodon.Client
 }
 
-func NewMastodon() (*Mastodon, error) {
-	m := &Mastodon{}
-	m.c = mastodon.NewClient(&mastodon.Config{
-		Server:       os.Getenv("MASTODON_SERVER"),
-		ClientID:     os.Getenv("MASTODON_CLIENT_ID"),
-		ClientSecret: os.Getenv("MASTODON_CLIENT_SECRET"),
+// This creates a Mastodon publisher. The connection is made when it's first needed.
+func NewMastodon(conf publisherConfig, templates *template.Template) *Mastodon {
+	if conf.EnvPrefix == "" {
+		conf.EnvPrefix = "MASTODON"
+	}
+	if conf.Server == "" {
+		conf.Server = os.Getenv(conf.EnvPrefix + "_SERVER")
+	}
+	if conf.MaxLength == 0 {
+		conf.MaxLength = mastodonDefaultMaxLength
+	}
+	if conf.ThreadWindowMinutes == 0 {
+		conf.ThreadWindowMinutes = 180
+	}
+	return &Mastodon{conf: conf, templates: templates}
+}
+
+// This connects and authenticates to the server, if we aren't already.
+func (m *Mastodon) connect(ctx context.Context) error {
+	if m.c != nil {
+		return nil
+	}
+	c := mastodon.NewClient(&mastodon.Config{
+		Server:       m.conf.Server,
+		ClientID:     os.Getenv(m.conf.EnvPrefix + "_CLIENT_ID"),
+		ClientSecret: os.Getenv(m.conf.EnvPrefix + "_CLIENT_SECRET"),
 	})
-	err := m.c.Authenticate(context.Background(), os.Getenv("MASTODON_USER_EMAIL"), os.Getenv("MASTODON_USER_PASSWORD"))
+	err := c.Authenticate(ctx, os.Getenv(m.conf.EnvPrefix+"_USER_EMAIL"), os.Getenv(m.conf.EnvPrefix+"_USER_PASSWORD"))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	m.c = c
+	return nil
+}
+
+func (m *Mastodon) Name() string {
+	return m.conf.Name
+}
+
+// Publishes a post as a status update. If this fails we drop the connection
+// so the next attempt re-authenticates.
+func (m *Mastodon) Publish(ctx context.Context, post postDetails) (publishedStatus, error) {
+	if err := m.connect(ctx); err != nil {
+		return publishedStatus{}, err
+	}
+	text, err := post.render(m.templates, m.conf.MaxLength)
+	if err != nil {
+		return publishedStatus{}, err
+	}
+	status, err := m.PostStatus(ctx, text, post.InReplyToID)
+	if err != nil {
+		m.c = nil
+		return publishedStatus{}, err
 	}
-	return m, nil
+	return publishedStatus{
+		ID:        string(status.ID),
+		URL:       status.URL,
+		Content:   text,
+		CreatedAt: status.CreatedAt,
+	}, nil
 }
 
-// Posts a status update
-func (m *Mastodon) PostStatus(status string) error {
-	_, err := m.c.PostStatus(context.Background(), &mastodon.Toot{
-		Status: status,
+func (m *Mastodon) ThreadingConfig() threadingConfig {
+	return threadingConfig{
+		SameCache:  m.conf.ThreadSameCache,
+		SameFinder: m.conf.ThreadSameFinder,
+		Window:     time.Duration(m.conf.ThreadWindowMinutes) * time.Minute,
+	}
+}
+
+// Checks we can authenticate and read our own account.
+func (m *Mastodon) HealthCheck(ctx context.Context) error {
+	if err := m.connect(ctx); err != nil {
+		return err
+	}
+	if _, err := m.c.GetAccountCurrentUser(ctx); err != nil {
+		m.c = nil
+		return err
+	}
+	return nil
+}
+
+func (m *Mastodon) Close() error {
+	m.c = nil
+	return nil
+}
+
+// Posts a status update, optionally as a reply to an earlier status
+func (m *Mastodon) PostStatus(ctx context.Context, status string, inReplyToID string) (*mastodon.Status, error) {
+	return m.c.PostStatus(ctx, &mastodon.Toot{
+		Status:      status,
+		InReplyToID: mastodon.ID(inReplyToID),
 	})
-	return err
 }
 
 // Gets my last `n` statuses
-func (m *Mastodon) GetMyStatuses(n int64) ([]*mastodon.Status, error) {
-	if account, err := m.c.GetAccountCurrentUser(context.Background()); err != nil {
+func (m *Mastodon) GetMyStatuses(ctx context.Context, n int64) ([]*mastodon.Status, error) {
+	if err := m.connect(ctx); err != nil {
+		return nil, err
+	}
+	if account, err := m.c.GetAccountCurrentUser(ctx); err != nil {
 		return nil, err
 	} else {
-		return m.c.GetAccountStatuses(context.Background(), account.ID, &mastodon.Pagination{
+		return m.c.GetAccountStatuses(ctx, account.ID, &mastodon.Pagination{
 			Limit: n,
 		})
 	}
 }
+
+// Reads back my last `n` statuses so we can avoid posting them again.
+func (m *Mastodon) RecentStatuses(ctx context.Context, n int64) ([]publishedStatus, error) {
+	statuses, err := m.GetMyStatuses(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	var result []publishedStatus
+	for _, s := range statuses {
+		result = append(result, publishedStatus{
+			ID:        string(s.ID),
+			URL:       s.URL,
+			Content:   s.Content,
+			CreatedAt: s.CreatedAt,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html"
+	"regexp"
+	"time"
+
+	"github.com/microcosm-cc/bluemonday"
+	log "github.com/sirupsen/logrus"
+)
+
+// The Outbox stores posts in the FinderDB before they're sent, so a post that
+// fails to publish is retried later instead of being lost. Delivery is
+// at-least-once: a crash between publishing and recording success will cause
+// a post to be sent again.
+type Outbox struct {
+	db         *FinderDB
+	publishers map[string]Publisher
+	kick       chan struct{}
+	now        func() time.Time
+
+	// How many times we try a post before giving up on it.
+	MaxAttempts int
+	// The delay after the first failure. This doubles with each attempt, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func NewOutbox(db *FinderDB, publishers []Publisher) *Outbox {
+	o := &Outbox{
+		db:          db,
+		publishers:  make(map[string]Publisher),
+		kick:        make(chan struct{}, 1),
+		now:         func() time.Time { return time.Now().UTC() },
+		MaxAttempts: 10,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    2 * time.Hour,
+	}
+	for _, p := range publishers {
+		o.publishers[p.Name()] = p
+	}
+	return o
+}
+
+// This queues each post for each publisher it goes to.
+func (o *Outbox) Enqueue(ctx context.Context, posts []postDetails) error {
+	db := o.db.WithContext(ctx)
+	for _, post := range posts {
+		for name := range o.publishers {
+			if !post.goesTo(name) {
+				continue
+			}
+			if err := db.EnqueuePost(name, post, o.now()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// This returns true if the post should be sent to the named publisher.
+func (p *postDetails) goesTo(publisher string) bool {
+	if len(p.Publishers) == 0 {
+		return true
+	}
+	for _, name := range p.Publishers {
+		if name == publisher {
+			return true
+		}
+	}
+	return false
+}
+
+// This returns how long to wait before the next attempt, given how many attempts have failed.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.BaseDelay
+	for i := 1; i < attempts && delay < o.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > o.MaxDelay {
+		delay = o.MaxDelay
+	}
+	return delay
+}
+
+// This makes one pass over the due posts, attempting to deliver each. It
+// returns the number of posts delivered. If ctx is cancelled it stops before
+// the next post.
+func (o *Outbox) Deliver(ctx context.Context) int {
+	var delivered int
+	db := o.db.WithContext(ctx)
+	for _, op := range db.DuePosts(o.now()) {
+		op := op
+		if ctx.Err() != nil {
+			break
+		}
+		p, ok := o.publishers[op.Publisher]
+		if !ok {
+			// The publisher has been removed from the config. Leave the post
+			// where it is in case it comes back.
+			continue
+		}
+		var post postDetails
+		if err := json.Unmarshal([]byte(op.Payload), &post); err != nil {
+			log.Errorf("Couldn't decode outbox post %d: %s", op.ID, err)
+			op.Status = outboxFailed
+			op.LastError = err.Error()
+			db.SaveOutboxPost(&op)
+			continue
+		}
+		if db.AlreadyPosted(op.Publisher, post.CacheCode, post.UserName, post.Kind) {
+			log.Printf("Not posting %s to %s, it's already on the timeline", post.CacheName, op.Publisher)
+			op.Status = outboxDuplicate
+			db.SaveOutboxPost(&op)
+			continue
+		}
+		if tp, ok := p.(threadingPublisher); ok && tp.ThreadingConfig().enabled() {
+			tc := tp.ThreadingConfig()
+			if parent := db.ThreadParent(op.Publisher, post.CacheCode, post.UserName, tc.SameCache, tc.SameFinder, o.now().Add(-tc.Window)); parent != nil {
+				post.InReplyToID = parent.StatusID
+			}
+		}
+		op.Attempts++
+		status, err := p.Publish(ctx, post)
+		if err != nil && ctx.Err() != nil {
+			// We're shutting down, which isn't the publisher's fault. Leave the
+			// post as it was so it's tried again straight away by Drain, or
+			// after a restart.
+			break
+		}
+		if err != nil {
+			op.LastError = err.Error()
+			if op.Attempts >= o.MaxAttempts {
+				log.Errorf("Giving up on post %d to %s after %d attempts: %s", op.ID, op.Publisher, op.Attempts, err)
+				op.Status = outboxFailed
+			} else {
+				op.NextAttempt = o.now().Add(o.backoff(op.Attempts))
+				log.Errorf("Failed to post to %s, retrying at %s: %s", op.Publisher, op.NextAttempt.Format(time.RFC3339), err)
+			}
+		} else {
+			log.Printf("Posted to %s: %s", op.Publisher, post.CacheName)
+			op.Status = outboxSent
+			op.SentAt = o.now()
+			op.LastError = ""
+			delivered++
+			ps := PostedStatus{
+				Publisher: op.Publisher,
+				StatusID:  status.ID,
+				URL:       status.URL,
+				CacheCode: post.CacheCode,
+				UserName:  post.UserName,
+				Kind:      post.Kind,
+				Text:      status.Content,
+				PostedAt:  op.SentAt,
+			}
+			if post.CacheFindID != 0 {
+				ps.CacheFindID = &post.CacheFindID
+			}
+			if err := db.RecordPostedStatus(&ps); err != nil {
+				log.Error(err)
+			}
+		}
+		// Record what happened even if we've been cancelled, or the post will be sent again.
+		if err := o.db.SaveOutboxPost(&op); err != nil {
+			log.Error(err)
+		}
+	}
+	return delivered
+}
+
+// This pulls the cache code out of a link to a geocache's details page.
+var geocacheURLRegex = regexp.MustCompile(`geocaching\.com/geocache/(GC[0-9A-Z]+)`)
+
+// This reads back the last n statuses from every publisher that supports it and
+// records them in the database, so anything already on the timeline isn't posted
+// again. This matters after a restart with queued posts, or after losing the
+// database. It returns the number of statuses recorded.
+func (o *Outbox) Reconcile(ctx context.Context, n int64) int {
+	var recorded int
+	db := o.db.WithContext(ctx)
+	policy := bluemonday.StrictPolicy()
+	for name, p := range o.publishers {
+		tr, ok := p.(timelineReader)
+		if !ok {
+			continue
+		}
+		statuses, err := tr.RecentStatuses(ctx, n)
+		if err != nil {
+			log.Errorf("Couldn't read back the timeline from %s: %s", name, err)
+			continue
+		}
+		for _, status := range statuses {
+			matches := geocacheURLRegex.FindStringSubmatch(status.Content)
+			if len(matches) < 2 {
+				continue
+			}
+			ps := PostedStatus{
+				Publisher: name,
+				StatusID:  status.ID,
+				URL:       status.URL,
+				CacheCode: matches[1],
+				Text:      html.UnescapeString(policy.Sanitize(status.Content)),
+				PostedAt:  status.CreatedAt,
+			}
+			// Link the status to a finder we know about, if we can.
+			if finder := postedFinder(ps.Text); finder != "" && contains(db.FinderNames(ps.CacheCode), finder) {
+				ps.UserName = finder
+				ps.CacheFindID = db.FindID(ps.CacheCode, finder)
+			}
+			if err := db.RecordPostedStatus(&ps); err != nil {
+				log.Error(err)
+				continue
+			}
+			recorded++
+		}
+	}
+	return recorded
+}
+
+// This makes a final delivery pass when we're shutting down. It returns the
+// number of posts still waiting to be delivered, either because we ran out of
+// time or because they failed and are waiting to be retried. They stay in the
+// outbox for next time.
+func (o *Outbox) Drain(ctx context.Context) int {
+	o.Deliver(ctx)
+	var undelivered int
+	for _, op := range o.db.PendingPosts() {
+		if _, ok := o.publishers[op.Publisher]; ok {
+			undelivered++
+		}
+	}
+	return undelivered
+}
+
+// This asks the delivery worker to make a pass now rather than waiting for its next tick.
+func (o *Outbox) Kick() {
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+}
+
+// This is the delivery worker. It delivers due posts every interval, or when
+// kicked, until ctx is cancelled.
+func (o *Outbox) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		o.Deliver(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.kick:
+		}
+	}
+}
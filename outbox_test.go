@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOutboxDelivery(t *testing.T) {
+	tempdir := t.TempDir()
+	timeNow := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	good := &mockPublisher{name: "good"}
+	bad := &mockPublisher{name: "bad", fail: true}
+	posts := []postDetails{
+		{CacheName: "Secret Hideout", UserName: "Amy"},
+		{CacheName: "Bingo Hall", UserName: "Beepo"},
+	}
+
+	db, err := NewFinderDB(tempdir + "/test.sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := NewOutbox(db, []Publisher{good, bad})
+	o.now = func() time.Time { return timeNow }
+	if err := o.Enqueue(context.Background(), posts); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 4, db.PendingPostCount(); want != got {
+		t.Errorf("Expected %d pending posts, got %d", want, got)
+	}
+	// The broken publisher shouldn't stop the other one getting its posts.
+	if want, got := 2, o.Deliver(context.Background()); want != got {
+		t.Errorf("Expected %d posts delivered, got %d", want, got)
+	}
+	if want, got := 2, len(good.posts); want != got {
+		t.Errorf("Expected %d posts to reach the good publisher, got %d", want, got)
+	}
+	// Nothing is due again until the backoff has elapsed.
+	if want, got := 0, len(db.DuePosts(timeNow)); want != got {
+		t.Errorf("Expected %d due posts, got %d", want, got)
+	}
+	db.Close()
+
+	// The failed posts should survive a restart.
+	db, err = NewFinderDB(tempdir + "/test.sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if want, got := 2, db.PendingPostCount(); want != got {
+		t.Errorf("Expected %d pending posts, got %d", want, got)
+	}
+	bad.fail = false
+	o = NewOutbox(db, []Publisher{good, bad})
+	o.now = func() time.Time { return timeNow.Add(o.BaseDelay) }
+	if want, got := 2, o.Deliver(context.Background()); want != got {
+		t.Errorf("Expected %d posts delivered, got %d", want, got)
+	}
+	if want, got := "Bingo Hall", bad.posts[1].CacheName; want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if want, got := 0, db.PendingPostCount(); want != got {
+		t.Errorf("Expected %d pending posts, got %d", want, got)
+	}
+}
+
+func TestOutboxGivesUp(t *testing.T) {
+	tempdir := t.TempDir()
+	timeNow := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	db, err := NewFinderDB(tempdir + "/test.sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bad := &mockPublisher{name: "bad", fail: true}
+	o := NewOutbox(db, []Publisher{bad})
+	o.MaxAttempts = 3
+	o.now = func() time.Time { return timeNow }
+	o.Enqueue(context.Background(), []postDetails{{CacheName: "Secret Hideout"}})
+	for i := 0; i < o.MaxAttempts; i++ {
+		o.Deliver(context.Background())
+		timeNow = timeNow.Add(o.MaxDelay)
+	}
+	if want, got := 0, db.PendingPostCount(); want != got {
+		t.Errorf("Expected %d pending posts, got %d", want, got)
+	}
+	var op OutboxPost
+	db.db.First(&op)
+	if want, got := outboxFailed, op.Status; want != got {
+		t.Errorf("Expected status %s, got %s", want, got)
+	}
+	if want, got := 3, op.Attempts; want != got {
+		t.Errorf("Expected %d attempts, got %d", want, got)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o := NewOutbox(nil, nil)
+	o.BaseDelay = time.Minute
+	o.MaxDelay = 10 * time.Minute
+	for attempts, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 5: 10 * time.Minute, 50: 10 * time.Minute} {
+		if got := o.backoff(attempts); want != got {
+			t.Errorf("Expected backoff after %d attempts to be %s, got %s", attempts, want, got)
+		}
+	}
+}
+
+type mockTimelinePublisher struct {
+	mockPublisher
+	statuses []publishedStatus
+}
+
+func (m *mockTimelinePublisher) RecentStatuses(ctx context.Context, n int64) ([]publishedStatus, error) {
+	return m.statuses, nil
+}
+
+func TestOutboxReconcile(t *testing.T) {
+	tempdir := t.TempDir()
+	db, err := NewFinderDB(tempdir + "/test.sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	p := &mockTimelinePublisher{mockPublisher: mockPublisher{name: "toots"}}
+	p.statuses = []publishedStatus{
+		{
+			ID:      "109",
+			Content: `<p>In Blerpville, &quot;Amy&quot; just found the &quot;Secret Hideout&quot; geocache! <a href="https://www.geocaching.com/geocache/GC1234">geocaching.com/geocache/GC1…</a></p>`,
+		},
+		{
+			ID:      "110",
+			Content: `<p>Not about geocaching at all</p>`,
+		},
+	}
+	o := NewOutbox(db, []Publisher{p})
+	if want, got := 1, o.Reconcile(context.Background(), 40); want != got {
+		t.Errorf("Expected %d statuses recorded, got %d", want, got)
+	}
+	// Doing it again shouldn't record anything twice.
+	o.Reconcile(context.Background(), 40)
+	var count int64
+	db.db.Model(&PostedStatus{}).Count(&count)
+	if want, got := int64(1), count; want != got {
+		t.Errorf("Expected %d statuses in the database, got %d", want, got)
+	}
+
+	o.Enqueue(context.Background(), []postDetails{
+		{CacheName: "Secret Hideout", CacheCode: "GC1234", UserName: "Amy"},
+		{CacheName: "Secret Hideout", CacheCode: "GC1234", UserName: "Beepo"},
+	})
+	o.Deliver(context.Background())
+	// Only Beepo's find should have been posted, Amy's was already on the timeline.
+	if want, got := 1, len(p.posts); want != got {
+		t.Fatalf("Expected %d posts, got %d", want, got)
+	}
+	if want, got := "Beepo", p.posts[0].UserName; want != got {
+		t.Errorf("Expected a post about %s, got %s", want, got)
+	}
+	// Now that Beepo's find has been posted, it shouldn't be posted again.
+	o.Enqueue(context.Background(), []postDetails{{CacheName: "Secret Hideout", CacheCode: "GC1234", UserName: "Beepo"}})
+	o.Deliver(context.Background())
+	if want, got := 1, len(p.posts); want != got {
+		t.Errorf("Expected %d posts, got %d", want, got)
+	}
+}
+
+func TestOutboxRecordsPosts(t *testing.T) {
+	tempdir := t.TempDir()
+	db, err := NewFinderDB(tempdir + "/test.sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	findID := addTestLog(db, "Amy", time.Now(), "GC1234", "dogs dogs dogs!")
+	p := &mockPublisher{name: "toots"}
+	o := NewOutbox(db, []Publisher{p})
+	post := postDetails{AreaName: "Blerpville", CacheName: "Secret Hideout", CacheCode: "GC1234", UserName: "Amy", CacheFindID: findID}
+	o.Enqueue(context.Background(), []postDetails{post})
+	o.Deliver(context.Background())
+
+	posts := db.PostsForFind(findID)
+	if want, got := 1, len(posts); want != got {
+		t.Fatalf("Expected %d posts for the find, got %d", want, got)
+	}
+	if want, got := "1", posts[0].StatusID; want != got {
+		t.Errorf("Expected status ID %s, got %s", want, got)
+	}
+	if want, got := "https://example.com/toots/1", posts[0].URL; want != got {
+		t.Errorf("Expected URL %s, got %s", want, got)
+	}
+	if want, got := "toots", posts[0].Publisher; want != got {
+		t.Errorf("Expected publisher %s, got %s", want, got)
+	}
+	if want, got := post.toString(500), posts[0].Text; want != got {
+		t.Errorf("Expected text %q, got %q", want, got)
+	}
+	// Check the relationship works from the other end too.
+	var find CacheFind
+	db.db.Preload("Posts").First(&find, findID)
+	if want, got := 1, len(find.Posts); want != got {
+		t.Errorf("Expected %d posts preloaded, got %d", want, got)
+	}
+}
+
+func TestOutboxThreading(t *testing.T) {
+	tempdir := t.TempDir()
+	timeNow := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	db, err := NewFinderDB(tempdir + "/test.sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	p := &mockPublisher{name: "toots", threading: threadingConfig{SameCache: true, Window: time.Hour}}
+	o := NewOutbox(db, []Publisher{p})
+	o.now = func() time.Time { return timeNow }
+
+	deliver := func(code, user string) postDetails {
+		o.Enqueue(context.Background(), []postDetails{{CacheCode: code, UserName: user}})
+		o.Deliver(context.Background())
+		return p.posts[len(p.posts)-1]
+	}
+
+	if want, got := "", deliver("GC1234", "Amy").InReplyToID; want != got {
+		t.Errorf("Expected the first post not to be a reply, got a reply to %q", got)
+	}
+	timeNow = timeNow.Add(10 * time.Minute)
+	if want, got := "1", deliver("GC1234", "Beepo").InReplyToID; want != got {
+		t.Errorf("Expected a reply to %q, got %q", want, got)
+	}
+	// A different cache starts its own thread.
+	if want, got := "", deliver("GC4567", "Beepo").InReplyToID; want != got {
+		t.Errorf("Expected no reply, got a reply to %q", got)
+	}
+	// The next find of the first cache replies to the latest post in its thread.
+	timeNow = timeNow.Add(10 * time.Minute)
+	if want, got := "2", deliver("GC1234", "Chaz").InReplyToID; want != got {
+		t.Errorf("Expected a reply to %q, got %q", want, got)
+	}
+	// Outside the window we start again.
+	timeNow = timeNow.Add(2 * time.Hour)
+	if want, got := "", deliver("GC1234", "Dot").InReplyToID; want != got {
+		t.Errorf("Expected no reply, got a reply to %q", got)
+	}
+
+	// Threading by finder follows the finder across caches.
+	p.threading = threadingConfig{SameFinder: true, Window: time.Hour}
+	if want, got := "5", deliver("GC7890", "Dot").InReplyToID; want != got {
+		t.Errorf("Expected a reply to %q, got %q", want, got)
+	}
+	// Status changes aren't about a finder, so they don't thread with each other.
+	timeNow = timeNow.Add(2 * time.Hour)
+	if want, got := "", deliver("GC2", "").InReplyToID; want != got {
+		t.Errorf("Expected no reply, got a reply to %q", got)
+	}
+	if want, got := "", deliver("GC3", "").InReplyToID; want != got {
+		t.Errorf("Expected no reply, got a reply to %q", got)
+	}
+	// Nor do digests, which aren't about a cache either.
+	p.threading = threadingConfig{SameCache: true, SameFinder: true, Window: time.Hour}
+	if want, got := "", deliver("", "").InReplyToID; want != got {
+		t.Errorf("Expected no reply, got a reply to %q", got)
+	}
+	if want, got := "", deliver("", "").InReplyToID; want != got {
+		t.Errorf("Expected no reply, got a reply to %q", got)
+	}
+	// But a status change still threads under the cache's earlier posts.
+	if want, got := "8", deliver("GC3", "").InReplyToID; want != got {
+		t.Errorf("Expected a reply to %q, got %q", want, got)
+	}
+}
+
+func TestOutboxRunStops(t *testing.T) {
+	db, err := NewFinderDB(t.TempDir() + "/test.sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	p := &mockPublisher{name: "mock"}
+	o := NewOutbox(db, []Publisher{p})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		o.Run(ctx, time.Hour)
+		close(done)
+	}()
+	o.Enqueue(context.Background(), []postDetails{{CacheName: "Secret Hideout"}})
+	o.Kick()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return once its context was cancelled")
+	}
+}
+
+// This is a publisher that gets shut down part way through publishing.
+type interruptedPublisher struct {
+	mockPublisher
+	cancel context.CancelFunc
+}
+
+func (m *interruptedPublisher) Publish(ctx context.Context, post postDetails) (publishedStatus, error) {
+	if m.cancel != nil {
+		m.cancel()
+		m.cancel = nil
+		return publishedStatus{}, ctx.Err()
+	}
+	return m.mockPublisher.Publish(ctx, post)
+}
+
+func TestOutboxDrain(t *testing.T) {
+	db, err := NewFinderDB(t.TempDir() + "/test.sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &interruptedPublisher{mockPublisher: mockPublisher{name: "mock"}, cancel: cancel}
+	o := NewOutbox(db, []Publisher{p})
+	o.Enqueue(context.Background(), []postDetails{
+		{CacheName: "Secret Hideout", CacheCode: "GC1234", UserName: "Amy"},
+		{CacheName: "Bingo Hall", CacheCode: "GC456798", UserName: "Beepo"},
+	})
+
+	// Being shut down mid-publish doesn't count as a failed attempt.
+	if want, got := 0, o.Deliver(ctx); want != got {
+		t.Errorf("Expected %d posts delivered, got %d", want, got)
+	}
+	var op OutboxPost
+	db.db.First(&op)
+	if want, got := 0, op.Attempts; want != got {
+		t.Errorf("Expected %d attempts, got %d", want, got)
+	}
+
+	// With no time left to drain, both are still queued.
+	if want, got := 2, o.Drain(ctx); want != got {
+		t.Errorf("Expected %d undelivered posts, got %d", want, got)
+	}
+
+	// With time to drain, both are sent.
+	if want, got := 0, o.Drain(context.Background()); want != got {
+		t.Errorf("Expected %d undelivered posts, got %d", want, got)
+	}
+	if want, got := 2, len(p.posts); want != got {
+		t.Errorf("Expected %d posts, got %d", want, got)
+	}
+
+	// A post that fails while draining is waiting to be retried, so it's still undelivered.
+	bad := &mockPublisher{name: "bad", fail: true}
+	o = NewOutbox(db, []Publisher{bad})
+	o.Enqueue(context.Background(), []postDetails{{CacheName: "Secret Hideout", CacheCode: "GC1234", UserName: "Amy"}})
+	if want, got := 1, o.Drain(context.Background()); want != got {
+		t.Errorf("Expected %d undelivered posts, got %d", want, got)
+	}
+}
+
+func TestOutboxRouting(t *testing.T) {
+	tempdir := t.TempDir()
+	db, err := NewFinderDB(tempdir + "/test.sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	north := &mockPublisher{name: "north"}
+	south := &mockPublisher{name: "south"}
+	o := NewOutbox(db, []Publisher{north, south})
+	o.Enqueue(context.Background(), []postDetails{
+		{CacheName: "Secret Hideout", Publishers: []string{"north"}},
+		{CacheName: "Bingo Hall"},
+	})
+	o.Deliver(context.Background())
+	if want, got := 2, len(north.posts); want != got {
+		t.Errorf("Expected %d posts to reach north, got %d", want, got)
+	}
+	if want, got := 1, len(south.posts); want != got {
+		t.Errorf("Expected %d posts to reach south, got %d", want, got)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// A Publisher is somewhere we can send posts, such as a Mastodon account.
+type Publisher interface {
+	// The name of this publisher, as given in the config.
+	Name() string
+	// Publish a single post, returning what was posted.
+	Publish(ctx context.Context, post postDetails) (publishedStatus, error)
+	// Check that the publisher is reachable and our credentials work.
+	HealthCheck(ctx context.Context) error
+	// Release any resources held by the publisher.
+	Close() error
+}
+
+// A timelineReader is a Publisher that can read back what it has posted.
+type timelineReader interface {
+	// This returns up to the last n statuses posted, newest first.
+	RecentStatuses(ctx context.Context, n int64) ([]publishedStatus, error)
+}
+
+// This is a status we've published, or read back from a publisher's timeline.
+// Publishers that don't assign IDs or URLs leave them empty.
+type publishedStatus struct {
+	ID        string
+	URL       string
+	Content   string // The rendered text we sent, or the raw HTML read back from a timeline.
+	CreatedAt time.Time
+}
+
+// A threadingPublisher is a Publisher that can post replies to its earlier statuses.
+type threadingPublisher interface {
+	ThreadingConfig() threadingConfig
+}
+
+// This controls which posts are threaded as replies to earlier ones.
+type threadingConfig struct {
+	// Reply to the last post about the same cache.
+	SameCache bool
+	// Reply to the last post about the same finder.
+	SameFinder bool
+	// Only reply to posts made within this long.
+	Window time.Duration
+}
+
+func (t threadingConfig) enabled() bool {
+	return (t.SameCache || t.SameFinder) && t.Window > 0
+}
+
+type publisherConfig struct {
+	Name string
+	// The kind of publisher, either "mastodon" or "webhook".
+	Type string
+	// The maximum length of a post, in characters. Zero uses the publisher's default.
+	MaxLength int
+
+	// Mastodon settings. Credentials are read from environment variables
+	// starting with EnvPrefix, E.G. MASTODON_SERVER, MASTODON_CLIENT_ID.
+	// Server overrides the <EnvPrefix>_SERVER environment variable if set.
+	Server    string
+	EnvPrefix string
+	// Post finds of the same cache, or by the same finder, as replies to the
+	// previous post if it was made within ThreadWindowMinutes.
+	ThreadSameCache     bool
+	ThreadSameFinder    bool
+	ThreadWindowMinutes int
+
+	// Webhook settings. The signing secret can also be given in the
+	// <EnvPrefix>_SECRET environment variable.
+	URL        string
+	Secret     string
+	MaxRetries int
+}
+
+// This builds a publisher from its config. Posts are rendered with the given
+// templates, or the defaults if that's nil.
+func NewPublisher(conf publisherConfig, templates *template.Template) (Publisher, error) {
+	if templates == nil {
+		templates = defaultTemplates
+	}
+	switch conf.Type {
+	case "mastodon":
+		return NewMastodon(conf, templates), nil
+	case "webhook":
+		return NewWebhook(conf, templates)
+	default:
+		return nil, fmt.Errorf("unknown publisher type %q for publisher %q", conf.Type, conf.Name)
+	}
+}
+
+// This builds all the publishers in the config.
+func NewPublishers(confs []publisherConfig, templates *template.Template) ([]Publisher, error) {
+	var publishers []Publisher
+	for _, conf := range confs {
+		p, err := NewPublisher(conf, templates)
+		if err != nil {
+			return nil, err
+		}
+		publishers = append(publishers, p)
+	}
+	return publishers, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type mockPublisher struct {
+	name      string
+	fail      bool
+	posts     []postDetails
+	threading threadingConfig
+}
+
+func (m *mockPublisher) Name() string {
+	return m.name
+}
+
+func (m *mockPublisher) Publish(ctx context.Context, post postDetails) (publishedStatus, error) {
+	if m.fail {
+		return publishedStatus{}, fmt.Errorf("%s is broken", m.name)
+	}
+	m.posts = append(m.posts, post)
+	return publishedStatus{
+		ID:        fmt.Sprint(len(m.posts)),
+		URL:       fmt.Sprintf("https://example.com/%s/%d", m.name, len(m.posts)),
+		Content:   post.toString(500),
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func (m *mockPublisher) ThreadingConfig() threadingConfig {
+	return m.threading
+}
+
+func (m *mockPublisher) HealthCheck(ctx context.Context) error {
+	return nil
+}
+
+func (m *mockPublisher) Close() error {
+	return nil
+}
+
+func TestNewPublisher(t *testing.T) {
+	if p, err := NewPublisher(publisherConfig{Name: "toots", Type: "mastodon"}, nil); err != nil {
+		t.Fatal(err)
+	} else if want, got := "toots", p.Name(); want != got {
+		t.Errorf("Expected name %s, got %s", want, got)
+	}
+	if _, err := NewPublisher(publisherConfig{Name: "pigeon", Type: "carrier-pigeon"}, nil); err == nil {
+		t.Error("Expected an error for an unknown publisher type")
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// These are the layouts of our posts, as text/template strings. See postDetails
+// for the fields available, and templateFuncs for the helper functions. Each
+// kind of post in logtypes.go has its own template.
+type postTemplates struct {
+	Find             string
+	NewCache         string
+	DNF              string
+	Milestone        string
+	Note             string
+	NeedsMaintenance string
+	OwnerMaintenance string
+	NeedsArchived    string
+	Archive          string
+	Unarchive        string
+	Disable          string
+	Enable           string
+	WillAttend       string
+	ReviewerNote     string
+	Other            string
+	Digest           string
+	CacheDisabled    string
+	CacheEnabled     string
+	CacheArchived    string
+	CacheUnarchived  string
+	CacheMissing     string
+	CacheReappeared  string
+}
+
+const defaultFindTemplate = `In {{.AreaName}}, "{{.UserName}}" just found the "{{.CacheName}}"{{if .PremiumOnly}} premium{{end}} geocache! {{.DetailsURL}}` +
+	`{{if gt .UsersFindsToday 1}} That's their {{ordinal .UsersFindsToday}} find today!{{end}} They wrote: "{{.LogText}}" #geocaching`
+
+const defaultNewCacheTemplate = `A new{{if .PremiumOnly}} premium{{end}} geocache has been published in {{.AreaName}}! ` +
+	`"{{.CacheName}}" ({{.CacheType}}, {{.ContainerType}}, D{{ftoa .Difficulty}}/T{{ftoa .Terrain}}) was hidden by "{{.UserName}}"` +
+	`{{if not .PlacedDate.IsZero}} on {{.PlacedDate.Format "2 January 2006"}}{{end}}. {{.DetailsURL}} #geocaching`
+
+const defaultDNFTemplate = `In {{.AreaName}}, "{{.UserName}}" couldn't find the "{{.CacheName}}"{{if .PremiumOnly}} premium{{end}} geocache. {{.DetailsURL}}` +
+	` They wrote: "{{.LogText}}" #geocaching`
+
+const defaultMilestoneTemplate = `{{emoji "milestone"}} In {{.AreaName}}, "{{.UserName}}" just found their {{ordinal .FinderFindCount}} geocache, "{{.CacheName}}"! {{.DetailsURL}}` +
+	` They wrote: "{{.LogText}}" #geocaching`
+
+const defaultNoteTemplate = `In {{.AreaName}}, "{{.UserName}}" wrote a note on the "{{.CacheName}}" geocache. {{.DetailsURL}} They wrote: "{{.LogText}}" #geocaching`
+
+const defaultNeedsMaintenanceTemplate = `{{emoji "maintenance"}} "{{.UserName}}" reports that the "{{.CacheName}}" geocache in {{.AreaName}} needs maintenance. {{.DetailsURL}}` +
+	` They wrote: "{{.LogText}}" #geocaching`
+
+const defaultOwnerMaintenanceTemplate = `{{emoji "maintenance"}} "{{.UserName}}" has done some maintenance on the "{{.CacheName}}" geocache in {{.AreaName}}. {{.DetailsURL}}` +
+	` They wrote: "{{.LogText}}" #geocaching`
+
+const defaultNeedsArchivedTemplate = `"{{.UserName}}" thinks the "{{.CacheName}}" geocache in {{.AreaName}} should be archived. {{.DetailsURL}}` +
+	` They wrote: "{{.LogText}}" #geocaching`
+
+const defaultArchiveTemplate = `{{emoji "archive"}} The "{{.CacheName}}" geocache in {{.AreaName}} has been archived. {{.DetailsURL}} "{{.UserName}}" wrote: "{{.LogText}}" #geocaching`
+
+const defaultUnarchiveTemplate = `The "{{.CacheName}}" geocache in {{.AreaName}} is back from the archives! {{.DetailsURL}} "{{.UserName}}" wrote: "{{.LogText}}" #geocaching`
+
+const defaultDisableTemplate = `The "{{.CacheName}}" geocache in {{.AreaName}} has been temporarily disabled. {{.DetailsURL}} "{{.UserName}}" wrote: "{{.LogText}}" #geocaching`
+
+const defaultEnableTemplate = `The "{{.CacheName}}" geocache in {{.AreaName}} can be found again! {{.DetailsURL}} "{{.UserName}}" wrote: "{{.LogText}}" #geocaching`
+
+const defaultWillAttendTemplate = `{{emoji "event"}} "{{.UserName}}" will be attending the "{{.CacheName}}" event in {{.AreaName}}. {{.DetailsURL}} #geocaching`
+
+const defaultReviewerNoteTemplate = `A reviewer has left a note on the "{{.CacheName}}" geocache in {{.AreaName}}. {{.DetailsURL}} They wrote: "{{.LogText}}" #geocaching`
+
+const defaultOtherTemplate = `In {{.AreaName}}, "{{.UserName}}" logged "{{.LogType}}" on the "{{.CacheName}}" geocache. {{.DetailsURL}} They wrote: "{{.LogText}}" #geocaching`
+
+const defaultDigestTemplate = `{{emoji "note"}} Recent geocaching news from {{.AreaName}}:{{range .Digest}}` +
+	`{{if .UserName}} "{{.UserName}}" logged {{.LogType}} on "{{.CacheName}}".{{else}} "{{.CacheName}}" {{.LogType}}.{{end}}{{end}} #geocaching`
+
+const defaultCacheDisabledTemplate = `The "{{.CacheName}}" geocache in {{.AreaName}} has been temporarily disabled. {{.DetailsURL}} #geocaching`
+
+const defaultCacheEnabledTemplate = `The "{{.CacheName}}" geocache in {{.AreaName}} can be found again! {{.DetailsURL}} #geocaching`
+
+const defaultCacheArchivedTemplate = `{{emoji "archive"}} The "{{.CacheName}}" geocache in {{.AreaName}} has been archived. {{.DetailsURL}} #geocaching`
+
+const defaultCacheUnarchivedTemplate = `The "{{.CacheName}}" geocache in {{.AreaName}} is back from the archives! {{.DetailsURL}} #geocaching`
+
+const defaultCacheMissingTemplate = `The "{{.CacheName}}" geocache has disappeared from {{.AreaName}}, it may have been archived. {{.DetailsURL}} #geocaching`
+
+const defaultCacheReappearedTemplate = `The "{{.CacheName}}" geocache in {{.AreaName}} has reappeared. {{.DetailsURL}} #geocaching`
+
+// The emoji available to templates through the emoji function.
+var templateEmoji = map[string]string{
+	"find":        "🎉",
+	"new":         "📦",
+	"dnf":         "😞",
+	"milestone":   "🏆",
+	"premium":     "💎",
+	"geocache":    "🌏",
+	"maintenance": "🔧",
+	"archive":     "🗄️",
+	"note":        "📝",
+	"event":       "📅",
+}
+
+var templateFuncs = template.FuncMap{
+	"ordinal":  humanize.Ordinal,
+	"ftoa":     humanize.Ftoa,
+	"truncate": truncate,
+	"emoji": func(name string) string {
+		return templateEmoji[name]
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// This returns the templates by name, filling in the defaults for any that
+// haven't been configured.
+func (t postTemplates) byName() map[string]string {
+	templates := map[string]string{
+		kindFind:             t.Find,
+		kindNewCache:         t.NewCache,
+		kindDNF:              t.DNF,
+		kindMilestone:        t.Milestone,
+		kindNote:             t.Note,
+		kindNeedsMaintenance: t.NeedsMaintenance,
+		kindOwnerMaintenance: t.OwnerMaintenance,
+		kindNeedsArchived:    t.NeedsArchived,
+		kindArchive:          t.Archive,
+		kindUnarchive:        t.Unarchive,
+		kindDisable:          t.Disable,
+		kindEnable:           t.Enable,
+		kindWillAttend:       t.WillAttend,
+		kindReviewerNote:     t.ReviewerNote,
+		kindOther:            t.Other,
+		kindDigest:           t.Digest,
+		kindCacheDisabled:    t.CacheDisabled,
+		kindCacheEnabled:     t.CacheEnabled,
+		kindCacheArchived:    t.CacheArchived,
+		kindCacheUnarchived:  t.CacheUnarchived,
+		kindCacheMissing:     t.CacheMissing,
+		kindCacheReappeared:  t.CacheReappeared,
+	}
+	defaults := map[string]string{
+		kindFind:             defaultFindTemplate,
+		kindNewCache:         defaultNewCacheTemplate,
+		kindDNF:              defaultDNFTemplate,
+		kindMilestone:        defaultMilestoneTemplate,
+		kindNote:             defaultNoteTemplate,
+		kindNeedsMaintenance: defaultNeedsMaintenanceTemplate,
+		kindOwnerMaintenance: defaultOwnerMaintenanceTemplate,
+		kindNeedsArchived:    defaultNeedsArchivedTemplate,
+		kindArchive:          defaultArchiveTemplate,
+		kindUnarchive:        defaultUnarchiveTemplate,
+		kindDisable:          defaultDisableTemplate,
+		kindEnable:           defaultEnableTemplate,
+		kindWillAttend:       defaultWillAttendTemplate,
+		kindReviewerNote:     defaultReviewerNoteTemplate,
+		kindOther:            defaultOtherTemplate,
+		kindDigest:           defaultDigestTemplate,
+		kindCacheDisabled:    defaultCacheDisabledTemplate,
+		kindCacheEnabled:     defaultCacheEnabledTemplate,
+		kindCacheArchived:    defaultCacheArchivedTemplate,
+		kindCacheUnarchived:  defaultCacheUnarchivedTemplate,
+		kindCacheMissing:     defaultCacheMissingTemplate,
+		kindCacheReappeared:  defaultCacheReappearedTemplate,
+	}
+	for name, text := range templates {
+		if text == "" {
+			templates[name] = defaults[name]
+		}
+	}
+	return templates
+}
+
+// This parses the templates and checks they render against some sample data,
+// so mistakes show up when the config is loaded rather than when we first post.
+func (t postTemplates) compile() (*template.Template, error) {
+	root := template.New("").Funcs(templateFuncs).Option("missingkey=error")
+	for name, text := range t.byName() {
+		if _, err := root.New(name).Parse(text); err != nil {
+			return nil, fmt.Errorf("couldn't parse the %s template: %w", name, err)
+		}
+	}
+	sample := postDetails{
+		AreaName:        "Brisbane",
+		UserName:        "Amy",
+		CacheName:       "Secret Hideout",
+		CacheCode:       "GC1234",
+		DetailsURL:      "https://www.geocaching.com/geocache/GC1234",
+		UsersFindsToday: 2,
+		LogText:         "TFTC!",
+		LogType:         "Found it",
+		FinderFindCount: 100,
+		CacheType:       "Traditional cache",
+		ContainerType:   "Small",
+		Difficulty:      1.5,
+		Terrain:         2,
+		PlacedDate:      time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Geocache: &Geocache{
+			Code:          "GC1234",
+			Name:          "Secret Hideout",
+			GeocacheType:  TraditionalCache,
+			ContainerType: SmallContainer,
+			CacheStatus:   StatusActive,
+		},
+		Digest: []DigestEntry{
+			{Kind: kindNeedsMaintenance, LogType: "Needs Maintenance", UserName: "Beepo", CacheName: "Bingo Hall", CacheCode: "GC4567"},
+		},
+	}
+	for _, tmpl := range root.Templates() {
+		if tmpl.Name() == "" {
+			continue
+		}
+		if err := tmpl.Execute(&strings.Builder{}, sample); err != nil {
+			return nil, fmt.Errorf("couldn't render the %s template: %w", tmpl.Name(), err)
+		}
+	}
+	return root, nil
+}
+
+// The templates used when none are configured.
+var defaultTemplates = func() *template.Template {
+	t, err := postTemplates{}.compile()
+	if err != nil {
+		panic(err)
+	}
+	return t
+}()
+
+// This returns true if a finder's total number of finds is worth celebrating.
+func isMilestone(finds int) bool {
+	return finds > 0 && finds%100 == 0
+}
+
+// This picks the template to use for the post.
+func (p *postDetails) templateName() string {
+	kind := p.Kind
+	if kind == "" {
+		// Posts queued before we tracked the kind were all finds.
+		kind = kindFind
+	}
+	switch {
+	case p.NewCache:
+		return kindNewCache
+	case kind == kindFind && isMilestone(p.FinderFindCount):
+		return kindMilestone
+	default:
+		return kind
+	}
+}
+
+// This renders the post using the given templates, fitting it within maxLength
+// characters as counted by Mastodon. If it's too long, the log text is shortened
+// as little as possible, since that's the least important part of the post, then
+// the cache's name. Links and hashtags are never cut. Only if it's still too long
+// without either is the whole post shortened.
+func (p *postDetails) render(t *template.Template, maxLength int) (string, error) {
+	execute := func(post postDetails) (string, error) {
+		var b strings.Builder
+		err := t.ExecuteTemplate(&b, post.templateName(), post)
+		return b.String(), err
+	}
+	message, err := execute(*p)
+	if err != nil || mastodonLength(message) <= maxLength {
+		return message, err
+	}
+
+	// This finds the most of the field we can keep, returning "" if the post
+	// doesn't fit even with just an elipsis, which is what the field is left as.
+	post := *p
+	shorten := func(field *string) (string, error) {
+		clusters := graphemes(*field)
+		if len(clusters) == 0 {
+			return "", nil
+		}
+		best, bestText := "", elipsis
+		low, high := 0, len(clusters)-1
+		for low <= high {
+			mid := (low + high) / 2
+			*field = strings.Join(clusters[:mid], "") + elipsis
+			candidate, err := execute(post)
+			if err != nil {
+				return "", err
+			}
+			if mastodonLength(candidate) <= maxLength {
+				best, bestText = candidate, *field
+				low = mid + 1
+			} else {
+				high = mid - 1
+			}
+		}
+		*field = bestText
+		return best, nil
+	}
+	for _, field := range []*string{&post.LogText, &post.CacheName} {
+		if message, err = shorten(field); message != "" || err != nil {
+			return message, err
+		}
+	}
+	if message, err = execute(post); err != nil {
+		return "", err
+	}
+	return truncatePost(message, maxLength), nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+var updateGolden = flag.Bool("update", false, "Update the golden files in testdata/golden")
+
+// This renders the post with the default templates as a single string no longer than maxLength.
+func (p *postDetails) toString(maxLength int) string {
+	message, err := p.render(defaultTemplates, maxLength)
+	if err != nil {
+		panic(err)
+	}
+	return message
+}
+
+// This compares got against the named golden file, or rewrites the file if -update was given.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name+".txt")
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Couldn't read golden file, run with -update to create it: %s", err)
+	}
+	if string(want) != got {
+		t.Errorf("Rendered post doesn't match %s:\nwant: %q\ngot:  %q", path, want, got)
+	}
+}
+
+// Returns a post about a find with some sensible test data
+func testFindPost() postDetails {
+	return postDetails{
+		AreaName:        "Blerpville",
+		UserName:        "Amy",
+		CacheName:       "Secret Hideout",
+		CacheCode:       "GC1234",
+		DetailsURL:      "https://www.geocaching.com/geocache/GC1234",
+		UsersFindsToday: 1,
+		LogText:         "dogs dogs dogs!",
+		LogType:         "Found it",
+		Kind:            kindFind,
+		FinderFindCount: 1123,
+	}
+}
+
+func TestTemplatesGolden(t *testing.T) {
+	multipleToday := testFindPost()
+	multipleToday.UsersFindsToday = 3
+
+	premium := testFindPost()
+	premium.PremiumOnly = true
+
+	longLog := testFindPost()
+	longLog.LogText = strings.Repeat("Had a great time at this event. Thanks for hosting! ", 20)
+
+	unicodeLog := testFindPost()
+	unicodeLog.LogText = strings.Repeat("Schöne Grüße aus Köln, danke für den Cache! ", 20)
+
+	emojiLog := testFindPost()
+	emojiLog.LogText = strings.Repeat("Found it with the kids 👨‍👩‍👧‍👦🇦🇺👍🏽 ", 40)
+
+	longName := testFindPost()
+	longName.CacheName = strings.Repeat("Very Long Name ", 40)
+
+	dnf := testFindPost()
+	dnf.LogType = "Didn't find it"
+	dnf.Kind = kindDNF
+	dnf.LogText = "Muggles everywhere, will try again."
+
+	needsMaintenance := testFindPost()
+	needsMaintenance.LogType = "Needs Maintenance"
+	needsMaintenance.Kind = kindNeedsMaintenance
+	needsMaintenance.LogText = "The log book is soaked."
+
+	digest := postDetails{
+		AreaName: "Blerpville",
+		Kind:     kindDigest,
+		Digest: []DigestEntry{
+			{Kind: kindNeedsMaintenance, LogType: "Needs Maintenance", UserName: "Amy", CacheName: "Secret Hideout"},
+			{Kind: kindDisable, LogType: "Temporarily Disable Listing", UserName: "JimblyBimbly", CacheName: "Bingo Hall"},
+		},
+	}
+
+	archived := postDetails{
+		AreaName:   "Blerpville",
+		CacheName:  "Bingo Hall",
+		CacheCode:  "GC4567",
+		DetailsURL: "https://www.geocaching.com/geocache/GC4567",
+		Kind:       kindCacheArchived,
+		LogType:    statusChangeDescriptions[kindCacheArchived],
+	}
+	digest.Digest = append(digest.Digest, DigestEntry{Kind: kindCacheDisabled, LogType: statusChangeDescriptions[kindCacheDisabled], CacheName: "Secret Hideout"})
+
+	milestone := testFindPost()
+	milestone.FinderFindCount = 500
+
+	newCache := postDetails{
+		AreaName:      "Blerpville",
+		UserName:      "JimblyBimbly",
+		CacheName:     "Bingo Hall",
+		CacheCode:     "GC4567",
+		DetailsURL:    "https://www.geocaching.com/geocache/GC4567",
+		NewCache:      true,
+		CacheType:     "Multi-cache",
+		ContainerType: "Small",
+		Difficulty:    2.5,
+		Terrain:       3,
+		PlacedDate:    time.Date(2023, 3, 2, 0, 0, 0, 0, time.UTC),
+	}
+
+	for name, post := range map[string]postDetails{
+		"find":              testFindPost(),
+		"find_multiple":     multipleToday,
+		"find_premium":      premium,
+		"find_long_log":     longLog,
+		"find_unicode":      unicodeLog,
+		"find_emoji":        emojiLog,
+		"find_long_name":    longName,
+		"dnf":               dnf,
+		"milestone":         milestone,
+		"needs_maintenance": needsMaintenance,
+		"digest":            digest,
+		"cache_archived":    archived,
+		"new_cache":         newCache,
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := post.render(defaultTemplates, 500)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := mastodonLength(got); got > 500 {
+				t.Errorf("Expected at most 500 characters, got %d", got)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("Rendered post isn't valid UTF-8: %q", got)
+			}
+			// Shortening a post should never lose its link.
+			if post.DetailsURL != "" && !strings.Contains(got, post.DetailsURL) {
+				t.Errorf("Expected the post to link to %s, got %q", post.DetailsURL, got)
+			}
+			checkGolden(t, name, got)
+		})
+	}
+}
+
+func TestTemplatesCustom(t *testing.T) {
+	tmpl, err := postTemplates{Find: `{{emoji "find"}} {{upper .UserName}} found {{.CacheCode}} ({{ordinal .UsersFindsToday}} today): {{truncate .LogText 5}}`}.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := testFindPost()
+	if got, err := post.render(tmpl, 500); err != nil {
+		t.Fatal(err)
+	} else if want := "🎉 AMY found GC1234 (1st today): dogs…"; want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	// The other templates should still have their defaults.
+	post.NewCache = true
+	if got, err := post.render(tmpl, 500); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(got, "A new geocache") {
+		t.Errorf("Expected the default new cache template, got %q", got)
+	}
+}
+
+func TestTemplatesGeocacheTypes(t *testing.T) {
+	tmpl, err := postTemplates{NewCache: `{{.Geocache.GeocacheType.Emoji}} {{.Geocache.GeocacheType}}, {{.Geocache.ContainerType.Name "de"}}`}.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := postDetails{NewCache: true, Geocache: &Geocache{GeocacheType: MultiCache, ContainerType: SmallContainer}}
+	if got, err := post.render(tmpl, 500); err != nil {
+		t.Fatal(err)
+	} else if want := "🔢 Multi-cache, Klein"; want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestTemplatesInvalid(t *testing.T) {
+	for name, templates := range map[string]postTemplates{
+		"syntax":         {Find: `{{.UserName`},
+		"unknown field":  {DNF: `{{.FavouriteColour}}`},
+		"unknown func":   {Milestone: `{{shout .UserName}}`},
+		"bad func usage": {NewCache: `{{ordinal .UserName}}`},
+	} {
+		if _, err := templates.compile(); err == nil {
+			t.Errorf("Expected an error for the %s template", name)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// The elipsis we put on the end of truncated text.
+const elipsis = "…"
+
+// Mastodon counts every URL as this many characters, however long it really is.
+const mastodonURLLength = 23
+
+var (
+	mastodonURLRegex     = regexp.MustCompile(`https?://[^\s]+`)
+	mastodonMentionRegex = regexp.MustCompile(`@(\w+)@[\w.-]+\w`)
+)
+
+// This reports whether r continues the grapheme cluster before it, rather than
+// starting a new one. It's a simplified version of the Unicode rules in UAX #29,
+// covering combining marks, variation selectors, emoji modifiers and tags.
+func isGraphemeExtend(r rune) bool {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc):
+		return true
+	case r == 0x200D: // Zero width joiner
+		return true
+	case r >= 0xFE00 && r <= 0xFE0F, r >= 0xE0100 && r <= 0xE01EF: // Variation selectors
+		return true
+	case r >= 0x1F3FB && r <= 0x1F3FF: // Emoji skin tone modifiers
+		return true
+	case r >= 0xE0020 && r <= 0xE007F: // Tags, used in flag sequences
+		return true
+	case r >= 0x1160 && r <= 0x11FF: // Hangul medial vowels and final consonants
+		return true
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// This splits a string into grapheme clusters, the things a person would count
+// as a single character. Invalid UTF-8 is treated as one cluster per byte.
+func graphemes(s string) []string {
+	var clusters []string
+	start := 0
+	var prev rune = -1
+	// Whether the previous regional indicator started a flag, so the next one ends it.
+	var openFlag bool
+	for i, r := range s {
+		join := false
+		switch {
+		case i == 0:
+		case prev == '\r' && r == '\n':
+			join = true
+		case prev == 0x200D:
+			// Anything after a zero width joiner is part of the same emoji sequence.
+			join = true
+		case isGraphemeExtend(r):
+			join = true
+		case isRegionalIndicator(r) && isRegionalIndicator(prev) && openFlag:
+			join = true
+		}
+		if isRegionalIndicator(r) {
+			openFlag = !join
+		} else {
+			openFlag = false
+		}
+		if !join && i > 0 {
+			clusters = append(clusters, s[start:i])
+			start = i
+		}
+		prev = r
+	}
+	if start < len(s) {
+		clusters = append(clusters, s[start:])
+	}
+	return clusters
+}
+
+// This returns the number of grapheme clusters in a string.
+func graphemeCount(s string) int {
+	return len(graphemes(s))
+}
+
+// This counts the characters in a post the same way a Mastodon server does:
+// each URL counts as 23 characters, mentions of remote users only count the
+// username, and everything else counts one per grapheme cluster.
+func mastodonLength(s string) int {
+	length := 0
+	last := 0
+	for _, loc := range mastodonURLRegex.FindAllStringIndex(s, -1) {
+		length += mentionAwareLength(s[last:loc[0]]) + mastodonURLLength
+		last = loc[1]
+	}
+	return length + mentionAwareLength(s[last:])
+}
+
+func mentionAwareLength(s string) int {
+	return graphemeCount(mastodonMentionRegex.ReplaceAllString(s, "@$1"))
+}
+
+// This truncates a string to at most max grapheme clusters. If truncation was
+// necessary, it adds an elipsis to the end of the string, within the max.
+func truncate(s string, max int) string {
+	clusters := graphemes(s)
+	if len(clusters) <= max {
+		return s
+	}
+	if max <= 1 {
+		return ""
+	}
+	return strings.Join(clusters[:max-1], "") + elipsis
+}
+
+// This splits the hashtags off the end of a post, so they can be kept whole when
+// the rest of the post is shortened.
+func splitTrailingHashtags(s string) (body, hashtags string) {
+	fields := strings.Fields(s)
+	i := len(fields)
+	for i > 0 && strings.HasPrefix(fields[i-1], "#") {
+		i--
+	}
+	if i == len(fields) {
+		return s, ""
+	}
+	hashtags = strings.Join(fields[i:], " ")
+	body = strings.TrimRightFunc(s, unicode.IsSpace)
+	body = strings.TrimSuffix(body, hashtags)
+	return strings.TrimRightFunc(body, unicode.IsSpace), hashtags
+}
+
+// This shortens a post to fit within maxLength as Mastodon counts it. Trailing
+// hashtags are always kept, and URLs and hashtags in the body are either kept
+// whole or dropped entirely rather than being cut in half.
+func truncatePost(s string, maxLength int) string {
+	if mastodonLength(s) <= maxLength {
+		return s
+	}
+	body, hashtags := splitTrailingHashtags(s)
+	suffix := elipsis
+	if hashtags != "" {
+		suffix += " " + hashtags
+	}
+	if mastodonLength(suffix) > maxLength {
+		// There's no room for anything, so just do our best.
+		return truncate(s, maxLength)
+	}
+	// Drop whole words from the end until the body fits, then put back as much
+	// of the last word as we can if it's ordinary text.
+	words := strings.SplitAfter(body, " ")
+	kept := ""
+	for _, word := range words {
+		if mastodonLength(kept+word+suffix) > maxLength {
+			trimmed := strings.TrimSpace(word)
+			if strings.HasPrefix(trimmed, "#") || mastodonURLRegex.MatchString(trimmed) {
+				break
+			}
+			for _, cluster := range graphemes(word) {
+				if mastodonLength(kept+cluster+suffix) > maxLength {
+					break
+				}
+				kept += cluster
+			}
+			break
+		}
+		kept += word
+	}
+	return strings.TrimRightFunc(kept, unicode.IsSpace) + suffix
+}
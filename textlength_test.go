@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestGraphemes(t *testing.T) {
+	for s, want := range map[string]int{
+		"":        0,
+		"abc":     3,
+		"Grüße":   5,
+		"é":      1, // e with a combining acute accent
+		"\r\n":    1,
+		"👍🏽":      1, // Thumbs up with a skin tone modifier
+		"👨‍👩‍👧‍👦": 1, // Family, joined with zero width joiners
+		"🇦🇺🇳🇿":    2, // Two flags made of regional indicators
+		"🏴󠁧󠁢󠁳󠁣󠁴󠁿": 1, // Scotland, made with tag characters
+		"❤️":      1, // Heart with a variation selector
+		"한국어":     3,
+		"각":     1, // Hangul syllable made of jamo
+	} {
+		if got := graphemeCount(s); want != got {
+			t.Errorf("Expected %q to have %d graphemes, got %d", s, want, got)
+		}
+	}
+}
+
+func TestMastodonLength(t *testing.T) {
+	for s, want := range map[string]int{
+		"hello": 5,
+		"https://www.geocaching.com/geocache/GC1234": 23,
+		"see http://x.co ok":                         4 + 23 + 3,
+		"hi @amy@mastodon.example":                   3 + 4,
+		"hi @amy":                                    7,
+		"👨‍👩‍👧‍👦 found it":                           10,
+		"café https://example.com":                  5 + 23,
+	} {
+		if got := mastodonLength(s); want != got {
+			t.Errorf("Expected %q to have length %d, got %d", s, want, got)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if want, got := "short", truncate("short", 10); want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if want, got := "abcdefghi…", truncate("abcdefghijklmnop", 10); want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if want, got := "Grüße", truncate("Grüße", 5); want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	// The family emoji is seven runes, but must be kept or dropped as one.
+	if want, got := "ab👨‍👩‍👧‍👦…", truncate("ab👨‍👩‍👧‍👦cdef", 4); want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if want, got := "é…", truncate("ééé", 2); want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestTruncatePost(t *testing.T) {
+	s := "Wow https://www.geocaching.com/geocache/GC1234 what a lovely day for it #geocaching #brisbane"
+	if want, got := s, truncatePost(s, 500); want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	// The hashtags are kept whole at the end.
+	if want, got := "Wow https://www.geocaching.com/geocache/GC1234 what a lo… #geocaching #brisbane", truncatePost(s, 60); want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	// The URL is dropped entirely rather than being cut.
+	if want, got := "Wow… #geocaching #brisbane", truncatePost(s, 40); want != got {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	long := strings.Repeat("Schöne Grüße 👍🏽 ", 100) + "#geocaching"
+	got := truncatePost(long, 500)
+	if mastodonLength(got) > 500 {
+		t.Errorf("Expected at most 500 characters, got %d", mastodonLength(got))
+	}
+	if !strings.HasSuffix(got, "… #geocaching") {
+		t.Errorf("Expected the hashtag to be kept, got %q", got)
+	}
+	if !utf8.ValidString(got) {
+		t.Errorf("Truncated post isn't valid UTF-8: %q", got)
+	}
+}
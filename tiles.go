@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// gc.com won't page past this many results in a single search, so an area with
+// more caches than this is split into smaller tiles.
+const maxSearchResults = 5000
+
+// We stop splitting tiles once they're this small. If there are still too many
+// caches in one we take what we can get.
+const minTileRadiusMeters = 250
+
+const earthRadiusMeters = 6371000
+
+// This returns the distance in metres between two points.
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+// This returns true if the cache is inside the search area.
+func (st *searchTerms) contains(gc *Geocache) bool {
+	return distanceMeters(float64(st.Latitude), float64(st.Longitude),
+		gc.PostedCoordinates.Latitude, gc.PostedCoordinates.Longitude) <= float64(st.RadiusMeters)
+}
+
+// This splits a search area into four overlapping circles, one over each quarter
+// of the square around it. Together they cover all of the original circle, plus
+// a bit extra around the corners.
+func splitTile(st searchTerms) []searchTerms {
+	half := float64(st.RadiusMeters) / 2
+	dLat := half / earthRadiusMeters * 180 / math.Pi
+	dLon := dLat / math.Cos(float64(st.Latitude)*math.Pi/180)
+	var tiles []searchTerms
+	for _, y := range []float64{1, -1} {
+		for _, x := range []float64{-1, 1} {
+			tile := st
+			tile.Latitude = float32(float64(st.Latitude) + y*dLat)
+			tile.Longitude = float32(float64(st.Longitude) + x*dLon)
+			tile.RadiusMeters = int(math.Ceil(half * math.Sqrt2))
+			tiles = append(tiles, tile)
+		}
+	}
+	return tiles
+}
+
+// This remembers how we've had to split up each search area, so we don't have to
+// work it out again on every search. It's saved to a file so it survives restarts.
+type tileCache struct {
+	filename string
+	mu       sync.Mutex
+	tiles    map[string][]searchTerms
+}
+
+// This returns a tileCache backed by filename, loading any tiles saved there. An
+// empty filename keeps the tiles in memory only.
+func newTileCache(filename string) *tileCache {
+	c := &tileCache{filename: filename, tiles: make(map[string][]searchTerms)}
+	if filename == "" {
+		return c
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("Couldn't load our search tiles: ", err)
+		}
+		return c
+	}
+	if err = json.Unmarshal(b, &c.tiles); err != nil {
+		log.Warn("Couldn't load our search tiles: ", err)
+		c.tiles = make(map[string][]searchTerms)
+	}
+	return c
+}
+
+// The tiles are keyed on where the area is, so moving or resizing an area starts afresh.
+func tileKey(st searchTerms) string {
+	return fmt.Sprintf("%f,%f,%d", st.Latitude, st.Longitude, st.RadiusMeters)
+}
+
+// This returns the tiles to search to cover the area. An area that has never
+// needed splitting is a single tile.
+func (c *tileCache) get(st searchTerms) []searchTerms {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	saved := c.tiles[tileKey(st)]
+	if len(saved) == 0 {
+		return []searchTerms{st}
+	}
+	tiles := make([]searchTerms, len(saved))
+	for i, tile := range saved {
+		tiles[i] = st
+		tiles[i].Latitude = tile.Latitude
+		tiles[i].Longitude = tile.Longitude
+		tiles[i].RadiusMeters = tile.RadiusMeters
+	}
+	return tiles
+}
+
+// This records the tiles we ended up searching to cover the area, and saves them
+// if they've changed.
+func (c *tileCache) set(st searchTerms, tiles []searchTerms) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := tileKey(st)
+	var saved []searchTerms
+	if len(tiles) > 1 {
+		for _, tile := range tiles {
+			saved = append(saved, searchTerms{Latitude: tile.Latitude, Longitude: tile.Longitude, RadiusMeters: tile.RadiusMeters})
+		}
+	}
+	if fmt.Sprint(saved) == fmt.Sprint(c.tiles[key]) {
+		return
+	}
+	if saved == nil {
+		delete(c.tiles, key)
+	} else {
+		c.tiles[key] = saved
+	}
+	if c.filename == "" {
+		return
+	}
+	b, err := json.Marshal(c.tiles)
+	if err == nil {
+		err = writeFileAtomic(c.filename, b)
+	}
+	if err != nil {
+		log.Warn("Couldn't save our search tiles: ", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	// Docker images often don't have a time zone database, so bring our own.
+	_ "time/tzdata"
+)
+
+// This is a rough box around somewhere with a single time zone.
+type timeZoneBox struct {
+	minLat, maxLat float64
+	minLon, maxLon float64
+	name           string
+}
+
+// This is a very coarse map of the world's time zones, good enough to guess the
+// zone of a search area from its centre. The first box a point falls in wins, so
+// smaller boxes come before the bigger ones they overlap. It's wrong near borders,
+// so set TimeZone in the config if it guesses badly.
+var timeZoneBoxes = []timeZoneBox{
+	// Australia and New Zealand
+	{-43.7, -39.5, 143.8, 148.5, "Australia/Hobart"},
+	{-39.2, -33.9, 140.9, 150.0, "Australia/Melbourne"},
+	{-37.6, -28.2, 141.0, 154.0, "Australia/Sydney"},
+	{-29.2, -9.0, 138.0, 154.0, "Australia/Brisbane"},
+	{-26.0, -10.9, 129.0, 138.0, "Australia/Darwin"},
+	{-38.1, -26.0, 129.0, 141.0, "Australia/Adelaide"},
+	{-35.2, -13.7, 112.9, 129.0, "Australia/Perth"},
+	{-47.5, -34.0, 166.0, 179.0, "Pacific/Auckland"},
+	// Asia
+	{33.0, 38.7, 124.0, 131.0, "Asia/Seoul"},
+	{24.0, 46.0, 122.9, 146.0, "Asia/Tokyo"},
+	{6.0, 36.0, 68.0, 97.5, "Asia/Kolkata"},
+	{18.0, 54.0, 73.0, 135.0, "Asia/Shanghai"},
+	{1.0, 7.5, 99.5, 119.5, "Asia/Singapore"},
+	// Europe
+	{51.4, 55.4, -10.7, -6.0, "Europe/Dublin"},
+	{49.8, 61.0, -8.2, 1.8, "Europe/London"},
+	{36.9, 42.2, -9.6, -6.2, "Europe/Lisbon"},
+	{49.0, 55.0, 14.1, 24.2, "Europe/Warsaw"},
+	{36.0, 71.0, -6.2, 19.0, "Europe/Berlin"},
+	{34.0, 70.0, 19.0, 30.0, "Europe/Helsinki"},
+	// North America
+	{18.9, 22.3, -160.3, -154.8, "Pacific/Honolulu"},
+	{51.0, 71.5, -170.0, -130.0, "America/Anchorage"},
+	{32.5, 49.0, -125.0, -114.5, "America/Los_Angeles"},
+	{31.3, 37.0, -114.8, -109.0, "America/Phoenix"},
+	{31.0, 49.0, -117.0, -102.0, "America/Denver"},
+	{25.8, 49.4, -102.0, -87.5, "America/Chicago"},
+	{24.5, 47.5, -87.5, -66.9, "America/New_York"},
+	{48.3, 60.0, -139.0, -114.0, "America/Vancouver"},
+	{49.0, 60.0, -120.0, -110.0, "America/Edmonton"},
+	{49.0, 60.0, -110.0, -101.4, "America/Regina"},
+	{49.0, 60.0, -101.4, -89.0, "America/Winnipeg"},
+	{41.7, 63.0, -89.0, -57.0, "America/Toronto"},
+	// South America and Africa
+	{-34.0, -5.0, -58.0, -34.8, "America/Sao_Paulo"},
+	{-55.0, -21.8, -73.6, -53.6, "America/Argentina/Buenos_Aires"},
+	{-35.0, -22.0, 16.0, 33.0, "Africa/Johannesburg"},
+}
+
+// This guesses the time zone at a point. Anywhere we don't have a box for gets a
+// fixed offset from UTC based on its longitude, which is right at sea at least.
+func timeZoneAt(lat, lon float64) *time.Location {
+	for _, box := range timeZoneBoxes {
+		if lat >= box.minLat && lat <= box.maxLat && lon >= box.minLon && lon <= box.maxLon {
+			if loc, err := time.LoadLocation(box.name); err == nil {
+				return loc
+			}
+		}
+	}
+	hours := int(math.Round(lon / 15))
+	return time.FixedZone(fmt.Sprintf("UTC%+d", hours), hours*60*60)
+}
+
+// This sets up the area's time zone, either from its config or by guessing from
+// where it is.
+func (st *searchTerms) loadTimeZone() error {
+	if st.TimeZone != "" {
+		loc, err := time.LoadLocation(st.TimeZone)
+		if err != nil {
+			return fmt.Errorf("search area %q: %w", st.AreaName, err)
+		}
+		st.location = loc
+		return nil
+	}
+	lat, lon := float64(st.Latitude), float64(st.Longitude)
+	if len(st.boundary) > 0 {
+		circle := st.searchCircles()[0]
+		lat, lon = float64(circle.Latitude), float64(circle.Longitude)
+	}
+	st.location = timeZoneAt(lat, lon)
+	return nil
+}
+
+// This returns the area's time zone. Dates from gc.com and "today" are in this zone.
+func (st *searchTerms) timeZone() *time.Location {
+	if st.location == nil {
+		return time.UTC
+	}
+	return st.location
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeZoneAt(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		lat, lon float64
+		want     string
+	}{
+		{"Brisbane", -27.46794, 153.02809, "Australia/Brisbane"},
+		{"Sydney", -33.8688, 151.2093, "Australia/Sydney"},
+		{"Perth", -31.9523, 115.8613, "Australia/Perth"},
+		{"London", 51.5072, -0.1276, "Europe/London"},
+		{"Seattle", 47.6062, -122.3321, "America/Los_Angeles"},
+		{"New York", 40.7128, -74.006, "America/New_York"},
+		{"Middle of the Pacific", 0, -150, "UTC-10"},
+	} {
+		if want, got := test.want, timeZoneAt(test.lat, test.lon).String(); want != got {
+			t.Errorf("%s: expected %s, got %s", test.name, want, got)
+		}
+	}
+}
+
+func TestLoadTimeZone(t *testing.T) {
+	st := searchTerms{AreaName: "Blerpville", Latitude: -27.46794, Longitude: 153.02809, TimeZone: "Pacific/Auckland"}
+	if err := st.loadTimeZone(); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "Pacific/Auckland", st.timeZone().String(); want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	st.TimeZone = ""
+	if err := st.loadTimeZone(); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "Australia/Brisbane", st.timeZone().String(); want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	st.TimeZone = "Australia/Blerpville"
+	if err := st.loadTimeZone(); err == nil {
+		t.Errorf("Expected an error for a time zone that doesn't exist")
+	}
+
+	// A log from the 16th in Brisbane was visited on the 15th in UTC.
+	visited, err := parseLogDate("3/16/2023", st.timeZone())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := time.Date(2023, 3, 15, 14, 0, 0, 0, time.UTC), visited.UTC(); want != got {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	// Just after midnight in Brisbane is still the day before in UTC.
+	now := time.Date(2023, 3, 15, 14, 30, 0, 0, time.UTC)
+	if want, got := visited, midnight(now, st.timeZone()); !want.Equal(got) {
+		t.Errorf("Expected midnight to be %s, got %s", want, got)
+	}
+}
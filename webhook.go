@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// Bump this whenever the shape of webhookPayload changes in a way receivers would notice.
+const webhookPayloadVersion = 1
+
+// The header carrying the HMAC-SHA256 signature of the request body.
+const webhookSignatureHeader = "X-Cacheodon-Signature"
+
+// This is the JSON document POSTed to the webhook.
+type webhookPayload struct {
+	Version   int         `json:"version"`
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Text      string      `json:"text"`
+	Post      postDetails `json:"post"`
+}
+
+type Webhook struct {
+	conf       publisherConfig
+	templates  *template.Template
+	client     *http.Client
+	secret     []byte
+	retryDelay time.Duration
+}
+
+// This creates a webhook publisher. The signing secret comes from the config, or
+// failing that from the <EnvPrefix>_SECRET environment variable.
+func NewWebhook(conf publisherConfig, templates *template.Template) (*Webhook, error) {
+	if conf.URL == "" {
+		return nil, fmt.Errorf("webhook publisher %q has no URL", conf.Name)
+	}
+	if conf.MaxLength == 0 {
+		conf.MaxLength = mastodonDefaultMaxLength
+	}
+	if conf.MaxRetries == 0 {
+		conf.MaxRetries = 3
+	}
+	w := &Webhook{
+		conf:       conf,
+		templates:  templates,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		retryDelay: time.Second,
+	}
+	if conf.Secret != "" {
+		w.secret = []byte(conf.Secret)
+	} else if conf.EnvPrefix != "" {
+		w.secret = []byte(os.Getenv(conf.EnvPrefix + "_SECRET"))
+	}
+	return w, nil
+}
+
+func (w *Webhook) Name() string {
+	return w.conf.Name
+}
+
+// This returns the hex-encoded HMAC-SHA256 of the body, or an empty string if
+// we don't have a secret.
+func (w *Webhook) sign(body []byte) string {
+	if len(w.secret) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhook) buildPayload(post postDetails) (webhookPayload, error) {
+	event := snakeCase(post.templateName())
+	text, err := post.render(w.templates, w.conf.MaxLength)
+	if err != nil {
+		return webhookPayload{}, err
+	}
+	return webhookPayload{
+		Version:   webhookPayloadVersion,
+		Event:     event,
+		Timestamp: time.Now().UTC(),
+		Text:      text,
+		Post:      post,
+	}, nil
+}
+
+// This turns a kind of post like "NeedsMaintenance" into an event name like "needs_maintenance".
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) && i > 0 && unicode.IsLower(rune(s[i-1])) {
+			b.WriteRune('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// This sends a single request, returning an error for anything other than a 2xx response.
+func (w *Webhook) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cacheodon")
+	if signature := w.sign(body); signature != "" {
+		req.Header.Set(webhookSignatureHeader, signature)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// This POSTs the post to the webhook, retrying with exponential backoff if it fails.
+func (w *Webhook) Publish(ctx context.Context, post postDetails) (publishedStatus, error) {
+	payload, err := w.buildPayload(post)
+	if err != nil {
+		return publishedStatus{}, err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return publishedStatus{}, err
+	}
+	delay := w.retryDelay
+	for attempt := 1; ; attempt++ {
+		if err = w.send(ctx, body); err == nil {
+			return publishedStatus{Content: payload.Text, CreatedAt: payload.Timestamp}, nil
+		}
+		if attempt >= w.conf.MaxRetries {
+			return publishedStatus{}, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return publishedStatus{}, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// Webhooks don't have a standard health endpoint, so all we can do is check the config.
+func (w *Webhook) HealthCheck(ctx context.Context) error {
+	if len(w.secret) == 0 {
+		return fmt.Errorf("webhook %q has no signing secret", w.conf.Name)
+	}
+	return nil
+}
+
+func (w *Webhook) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookPublish(t *testing.T) {
+	secret := "hunter2"
+	var requests int
+	var payload webhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// Fail the first attempt to exercise the retry.
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if want, got := "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get(webhookSignatureHeader); want != got {
+			t.Errorf("Expected signature %s, got %s", want, got)
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	p, err := NewPublisher(publisherConfig{Name: "hook", Type: "webhook", URL: server.URL, Secret: secret}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.(*Webhook).retryDelay = time.Millisecond
+	post := postDetails{
+		AreaName:  "Blerpville",
+		UserName:  "Amy",
+		CacheName: "Secret Hideout",
+		LogText:   "dogs dogs dogs!",
+		Geocache:  &Geocache{Code: "GC1234"},
+		Log:       &GeocacheLog{LogID: 1234, LogType: "Found it"},
+	}
+	if _, err := p.Publish(context.Background(), post); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, requests; want != got {
+		t.Errorf("Expected %d requests, got %d", want, got)
+	}
+	if want, got := webhookPayloadVersion, payload.Version; want != got {
+		t.Errorf("Expected version %d, got %d", want, got)
+	}
+	if want, got := "find", payload.Event; want != got {
+		t.Errorf("Expected event %s, got %s", want, got)
+	}
+	if want, got := "GC1234", payload.Post.Geocache.Code; want != got {
+		t.Errorf("Expected cache code %s, got %s", want, got)
+	}
+	if want, got := 1234, payload.Post.Log.LogID; want != got {
+		t.Errorf("Expected log ID %d, got %d", want, got)
+	}
+	if want, got := post.toString(500), payload.Text; want != got {
+		t.Errorf("Expected text %q, got %q", want, got)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	w, err := NewWebhook(publisherConfig{Name: "hook", URL: server.URL, MaxRetries: 4}, defaultTemplates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.retryDelay = time.Millisecond
+	if _, err := w.Publish(context.Background(), postDetails{CacheName: "Bingo Hall"}); err == nil {
+		t.Error("Expected an error, got none")
+	}
+	if want, got := 4, requests; want != got {
+		t.Errorf("Expected %d requests, got %d", want, got)
+	}
+}